@@ -243,7 +243,7 @@ func (c *Contractor) Editor(id types.FileContractID, cancel <-chan struct{}) (_
 	}
 
 	// create editor
-	e, err := proto.NewEditor(host, contract, height, c.hdb, cancel)
+	e, err := proto.NewEditor(host, contract, height, c.hdb, cancel, proto.EditorOptions{})
 	if proto.IsRevisionMismatch(err) {
 		// try again with the cached revision
 		c.mu.RLock()
@@ -257,7 +257,7 @@ func (c *Contractor) Editor(id types.FileContractID, cancel <-chan struct{}) (_
 		c.log.Printf("host %v has different revision for %v; retrying with cached revision", contract.NetAddress, contract.ID)
 		contract.LastRevision = cached.Revision
 		contract.MerkleRoots = cached.MerkleRoots
-		e, err = proto.NewEditor(host, contract, height, c.hdb, cancel)
+		e, err = proto.NewEditor(host, contract, height, c.hdb, cancel, proto.EditorOptions{})
 		// needs to be handled separately since a revision mismatch is not automatically a failed interaction
 		if proto.IsRevisionMismatch(err) {
 			c.hdb.IncrementFailedInteractions(host.PublicKey)
@@ -0,0 +1,97 @@
+package proto
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// ErrHostCircuitOpen is returned by NewEditor if the host has failed too many
+// consecutive times and its cooldown has not yet elapsed.
+var ErrHostCircuitOpen = errors.New("host has failed repeatedly; not retrying until cooldown elapses")
+
+// A HostBreaker tracks consecutive failures to connect to each host. Once a
+// host reaches Threshold consecutive failures, its circuit opens, and attempts
+// are rejected until Cooldown has elapsed. A single attempt after the
+// cooldown is then allowed through as a probe, and further attempts are
+// rejected while it is in flight; if it fails, the circuit opens again, and
+// if it succeeds, the host's failures are reset. A HostBreaker is safe for
+// concurrent use and may be shared between Editors.
+type HostBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostCircuit
+	mu        sync.Mutex
+
+	// clock is the source of the current time for cooldowns. If nil, the
+	// system clock is used.
+	clock clock
+}
+
+// hostCircuit is the breaker state of a single host.
+type hostCircuit struct {
+	failures int
+	openedAt time.Time
+}
+
+// NewHostBreaker returns a HostBreaker that opens after threshold consecutive
+// failures and stays open for cooldown. threshold must be at least 1, and
+// cooldown must be positive.
+func NewHostBreaker(threshold int, cooldown time.Duration) (*HostBreaker, error) {
+	if threshold < 1 {
+		return nil, errors.New("breaker threshold must be at least 1")
+	} else if cooldown <= 0 {
+		return nil, errors.New("breaker cooldown must be positive")
+	}
+	return &HostBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostCircuit),
+	}, nil
+}
+
+// now returns the current time according to the HostBreaker's clock.
+func (hb *HostBreaker) now() time.Time {
+	if hb.clock == nil {
+		return time.Now()
+	}
+	return hb.clock.Now()
+}
+
+// allow returns true if an attempt to connect to the host should be made.
+func (hb *HostBreaker) allow(host types.SiaPublicKey) bool {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hc, ok := hb.hosts[host.String()]
+	if !ok || hc.failures < hb.threshold {
+		return true
+	} else if hb.now().Sub(hc.openedAt) < hb.cooldown {
+		return false
+	}
+	// let a single probe through, restarting the cooldown so that other
+	// attempts are rejected until its outcome is recorded
+	hc.openedAt = hb.now()
+	return true
+}
+
+// record records the outcome of an attempt to connect to the host.
+func (hb *HostBreaker) record(host types.SiaPublicKey, success bool) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	key := host.String()
+	if success {
+		delete(hb.hosts, key)
+		return
+	}
+	hc, ok := hb.hosts[key]
+	if !ok {
+		hc = new(hostCircuit)
+		hb.hosts[key] = hc
+	}
+	hc.failures++
+	if hc.failures >= hb.threshold {
+		hc.openedAt = hb.now()
+	}
+}
@@ -0,0 +1,105 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// errCompressedSectorMalformed is returned by DecompressSector if the
+// sector's header is invalid.
+var errCompressedSectorMalformed = errors.New("compressed sector has invalid header")
+
+// Sectors uploaded by UploadCompressed begin with a header consisting of a
+// marker byte, which records whether the payload is compressed, and the
+// length of the payload. The payload follows the header, and the rest of the
+// sector is zero padding.
+const (
+	sectorMarkerRaw        = 0
+	sectorMarkerCompressed = 1
+
+	compressedSectorHeaderSize = 9
+)
+
+// MaxCompressedUploadSize is the largest payload accepted by
+// UploadCompressed. Payloads that do not compress must still fit in a sector
+// alongside the header.
+const MaxCompressedUploadSize = modules.SectorSize - compressedSectorHeaderSize
+
+// A Codec compresses and decompresses sector data.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec that uses gzip compression.
+type GzipCodec struct{}
+
+// Compress implements Codec.
+func (GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Codec.
+func (GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// compressSector returns a full sector containing data compressed with
+// codec, preceded by a header. If the compressed data does not fit in a
+// sector, the sector contains the raw data instead, and its header marks it
+// as such. data must not exceed MaxCompressedUploadSize.
+func compressSector(data []byte, codec Codec) ([]byte, error) {
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	marker, payload := byte(sectorMarkerCompressed), compressed
+	if uint64(len(compressed)) > MaxCompressedUploadSize {
+		marker, payload = sectorMarkerRaw, data
+	}
+	sector := make([]byte, modules.SectorSize)
+	sector[0] = marker
+	copy(sector[1:], encoding.EncUint64(uint64(len(payload))))
+	copy(sector[compressedSectorHeaderSize:], payload)
+	return sector, nil
+}
+
+// DecompressSector returns the original data of a sector uploaded by
+// UploadCompressed. The sector's header records whether the sector was
+// compressed; if it was, it is decompressed using codec, which must be the
+// codec passed to UploadCompressed.
+func DecompressSector(sector []byte, codec Codec) ([]byte, error) {
+	if len(sector) < compressedSectorHeaderSize {
+		return nil, errCompressedSectorMalformed
+	}
+	n := encoding.DecUint64(sector[1:compressedSectorHeaderSize])
+	if n > uint64(len(sector)-compressedSectorHeaderSize) {
+		return nil, errCompressedSectorMalformed
+	}
+	payload := sector[compressedSectorHeaderSize : compressedSectorHeaderSize+n]
+	switch sector[0] {
+	case sectorMarkerRaw:
+		return append([]byte(nil), payload...), nil
+	case sectorMarkerCompressed:
+		return codec.Decompress(payload)
+	default:
+		return nil, errCompressedSectorMalformed
+	}
+}
@@ -1,25 +1,312 @@
 package proto
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
 	"github.com/NebulousLabs/Sia/modules"
 	"github.com/NebulousLabs/Sia/types"
 )
 
-// A safeContract protects a RenterContract with a mutex.
+var (
+	// ErrContractNotFound is returned when the requested contract is not
+	// present in the set.
+	ErrContractNotFound = errors.New("no contract with that id")
+
+	// ErrMerkleRootMismatch is returned by AcquireVerified if a contract's
+	// Merkle roots do not match the Merkle root of its last revision.
+	ErrMerkleRootMismatch = errors.New("contract's Merkle roots do not match its revision")
+
+	// ErrAcquireTimeout is returned by AcquireVerified if the contract could
+	// not be acquired within the set's AcquireTimeout.
+	ErrAcquireTimeout = errors.New("timed out waiting to acquire contract")
+)
+
+// A fifoLock is a readers-writer lock that is granted to waiters in the
+// order that they called lock or rlock, so that no waiter can be starved by
+// others repeatedly re-acquiring the lock. Waiters with a higher priority are
+// queued ahead of those with a lower one. Consecutive readers at the front of
+// the queue share the lock. Waiting for the lock can be interrupted. The zero
+// value is an unlocked fifoLock.
+type fifoLock struct {
+	locked  bool // held by a writer
+	readers int  // number of readers holding the lock
+	waiters []fifoWaiter
+
+	// in debug builds, the time at which the lock was acquired, the stack of
+	// the goroutine that acquired it, and the trace ID of the request that
+	// acquired it, if known, for finding leaked locks
+	lockedAt time.Time
+	stack    []byte
+	traceID  string
+
+	mu sync.Mutex
+}
+
+// A fifoWaiter is a caller waiting for a fifoLock. ch is closed when the lock
+// is granted to the waiter.
+type fifoWaiter struct {
+	ch     chan struct{}
+	shared bool
+	prio   int
+}
+
+// setHolder records the current goroutine as the holder of the lock. It is a
+// no-op outside of debug builds. l.mu must be held.
+func (l *fifoLock) setHolder() {
+	if build.DEBUG {
+		l.lockedAt = time.Now()
+		l.stack = debug.Stack()
+	}
+}
+
+// setTraceID records traceID as the trace ID of the lock's holder. It is a
+// no-op outside of debug builds.
+func (l *fifoLock) setTraceID(traceID string) {
+	if build.DEBUG {
+		l.mu.Lock()
+		l.traceID = traceID
+		l.mu.Unlock()
+	}
+}
+
+// lock acquires the lock exclusively, blocking until it is available. If
+// cancel is closed first, lock returns false without acquiring the lock.
+func (l *fifoLock) lock(cancel <-chan struct{}) bool {
+	return l.acquire(false, 0, cancel)
+}
+
+// lockPriority is like lock, but if the lock is held, queues the caller
+// ahead of any waiters with a lower priority than prio.
+func (l *fifoLock) lockPriority(prio int, cancel <-chan struct{}) bool {
+	return l.acquire(false, prio, cancel)
+}
+
+// rlock is like lock, but acquires the lock for reading, which may be shared
+// with other readers.
+func (l *fifoLock) rlock(cancel <-chan struct{}) bool {
+	return l.acquire(true, 0, cancel)
+}
+
+// acquire implements lock, lockPriority, and rlock.
+func (l *fifoLock) acquire(shared bool, prio int, cancel <-chan struct{}) bool {
+	l.mu.Lock()
+	if l.available(shared) {
+		l.grant(shared)
+		if !shared {
+			l.setHolder()
+		}
+		l.mu.Unlock()
+		return true
+	}
+	// queue behind every waiter of the same or higher priority
+	w := fifoWaiter{ch: make(chan struct{}), shared: shared, prio: prio}
+	i := len(l.waiters)
+	for i > 0 && l.waiters[i-1].prio < prio {
+		i--
+	}
+	l.waiters = append(l.waiters, fifoWaiter{})
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+	l.mu.Unlock()
+
+	select {
+	case <-w.ch:
+		if !shared {
+			l.mu.Lock()
+			l.setHolder()
+			l.mu.Unlock()
+		}
+		return true
+	case <-cancel:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.waiters {
+		if l.waiters[i].ch == w.ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			// readers queued behind a departing writer may now be able to
+			// share the lock
+			l.wake()
+			return false
+		}
+	}
+	// the lock was handed to us before we could leave the queue; pass it on
+	l.release(shared)
+	return false
+}
+
+// available reports whether the lock can be granted immediately. A reader
+// does not join the current readers if anyone is waiting, so that waiting
+// writers are not starved. l.mu must be held.
+func (l *fifoLock) available(shared bool) bool {
+	if shared {
+		return !l.locked && len(l.waiters) == 0
+	}
+	return !l.locked && l.readers == 0
+}
+
+// grant marks the lock as held. l.mu must be held.
+func (l *fifoLock) grant(shared bool) {
+	if shared {
+		l.readers++
+	} else {
+		l.locked = true
+	}
+}
+
+// tryLock acquires the lock exclusively if it is available, without
+// blocking. It reports whether the lock was acquired.
+func (l *fifoLock) tryLock() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.available(false) {
+		return false
+	}
+	l.grant(false)
+	l.setHolder()
+	return true
+}
+
+// unlock releases an exclusively-held lock, handing it to the longest-waiting
+// callers, if any. It is a developer error to unlock a fifoLock that is not
+// locked.
+func (l *fifoLock) unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.locked {
+		build.Critical("unlock of unlocked contract")
+		return
+	}
+	l.release(false)
+}
+
+// runlock releases a lock held for reading. It is a developer error to
+// runlock a fifoLock that is not held for reading.
+func (l *fifoLock) runlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers == 0 {
+		build.Critical("runlock of contract not locked for reading")
+		return
+	}
+	l.release(true)
+}
+
+// release gives up one hold on the lock and wakes any waiters that can then
+// acquire it. l.mu must be held.
+func (l *fifoLock) release(shared bool) {
+	if shared {
+		l.readers--
+	} else {
+		l.locked = false
+		l.lockedAt, l.stack, l.traceID = time.Time{}, nil, ""
+	}
+	l.wake()
+}
+
+// wake grants the lock to as many waiters at the front of the queue as
+// possible: either a single writer, or a run of readers. l.mu must be held.
+func (l *fifoLock) wake() {
+	for len(l.waiters) > 0 {
+		w := l.waiters[0]
+		if l.locked || (!w.shared && l.readers > 0) {
+			return
+		}
+		l.grant(w.shared)
+		close(w.ch)
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// A safeContract protects a RenterContract with a lock.
 type safeContract struct {
 	modules.RenterContract
-	mu sync.Mutex
+	mu fifoLock
+
+	// deleted is set, under the set's lock, when the contract is removed
+	// from the set, so that goroutines waiting for mu do not acquire it
+	deleted bool
+}
+
+// newSafeContract returns an unlocked safeContract wrapping c. In debug
+// builds, a contract that is garbage collected while acquired, e.g. because
+// its set was discarded without returning it, is reported as leaked.
+func newSafeContract(c modules.RenterContract) *safeContract {
+	sc := &safeContract{
+		RenterContract: c,
+	}
+	if build.DEBUG {
+		runtime.SetFinalizer(sc, checkLeaked)
+	}
+	return sc
+}
+
+// leakHook, if set, is called by reportLeak instead of writing to stderr. It
+// allows tests to observe leaks.
+var (
+	leakHook   func(id types.FileContractID, stack []byte)
+	leakHookMu sync.Mutex
+)
+
+// checkLeaked is the finalizer of a safeContract in debug builds. sc is
+// unreachable, so its fields can be read without holding the set's lock.
+func checkLeaked(sc *safeContract) {
+	sc.mu.mu.Lock()
+	held := sc.mu.locked || sc.mu.readers > 0
+	stack := sc.mu.stack
+	sc.mu.mu.Unlock()
+	if held && !sc.deleted {
+		reportLeak(sc.ID, stack)
+	}
+}
+
+// reportLeak reports that the contract with the specified ID was garbage
+// collected while acquired at stack. Since finalizers cannot be recovered
+// from, it writes to stderr rather than panicking.
+func reportLeak(id types.FileContractID, stack []byte) {
+	leakHookMu.Lock()
+	defer leakHookMu.Unlock()
+	if leakHook != nil {
+		leakHook(id, stack)
+		return
+	}
+	os.Stderr.WriteString("contract " + id.String() + " was garbage collected while acquired; it was acquired at:\n" + string(stack))
 }
 
 // A ContractSet provides safe concurrent access to a set of contracts. Its
 // purpose is to serialize modifications to individual contracts, as well as
 // to provide operations on the set as a whole.
 type ContractSet struct {
-	contracts map[types.FileContractID]*safeContract
-	mu        sync.Mutex
+	// acquires counts successful acquisitions; it is first in the struct so
+	// that it is 64-bit aligned for atomic access
+	acquires uint64
+
+	contracts   map[types.FileContractID]*safeContract
+	subscribers map[chan modules.RenterContract]struct{}
+	mu          sync.Mutex
+
+	// AcquireTimeout, if nonzero, is the longest that Acquire, and the
+	// methods built on it, wait for a contract's lock before giving up. It
+	// guards against contracts that are never returned. AcquireCancel and
+	// AcquireCtx are not affected, and may be used to wait longer.
+	AcquireTimeout time.Duration
 }
 
 // Len returns the number of contracts in the set.
@@ -29,6 +316,15 @@ func (cs *ContractSet) Len() int {
 	return len(cs.contracts)
 }
 
+// Has returns true if the specified contract is in the set. The contract is
+// not locked.
+func (cs *ContractSet) Has(id types.FileContractID) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	_, ok := cs.contracts[id]
+	return ok
+}
+
 // IDs returns the FileContractID of each contract in the set. The contracts
 // are not locked.
 func (cs *ContractSet) IDs() []types.FileContractID {
@@ -57,6 +353,303 @@ func (cs *ContractSet) Contracts() []modules.RenterContract {
 	return contracts
 }
 
+// Hosts returns the distinct public keys of the hosts that the set has
+// contracts with, sorted by their string form.
+func (cs *ContractSet) Hosts() []types.SiaPublicKey {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	seen := make(map[string]struct{})
+	var hosts []types.SiaPublicKey
+	for _, sc := range cs.contracts {
+		key := sc.HostPublicKey.String()
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			hosts = append(hosts, sc.HostPublicKey)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].String() < hosts[j].String()
+	})
+	return hosts
+}
+
+// HasHost reports whether the set contains a contract with the host whose
+// public key is pk.
+func (cs *ContractSet) HasHost(pk types.SiaPublicKey) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	key := pk.String()
+	for _, sc := range cs.contracts {
+		if sc.HostPublicKey.String() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint returns a digest of c's fields, excluding its secret key, and
+// the Merkle root of its sector roots.
+func fingerprint(c modules.RenterContract) crypto.Hash {
+	root := cachedMerkleRoot(c.MerkleRoots)
+	c.MerkleRoots = nil
+	c.SecretKey = crypto.SecretKey{}
+	return crypto.HashAll(c, root)
+}
+
+// Fingerprint returns a digest of the specified contract that can be
+// compared to detect any difference between two copies of it, such as in a
+// backup. The secret key is not included, so fingerprints may be shared. If
+// the contract is not present in the set, Fingerprint returns false.
+func (cs *ContractSet) Fingerprint(id types.FileContractID) (crypto.Hash, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return crypto.Hash{}, false
+	}
+	return fingerprint(sc.RenterContract), true
+}
+
+// FingerprintAll returns the Fingerprint of each contract in the set.
+func (cs *ContractSet) FingerprintAll() map[types.FileContractID]crypto.Hash {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	fps := make(map[types.FileContractID]crypto.Hash, len(cs.contracts))
+	for id, sc := range cs.contracts {
+		fps[id] = fingerprint(sc.RenterContract)
+	}
+	return fps
+}
+
+// RootCount returns the number of Merkle roots in the specified contract. If
+// the contract is not present in the set, RootCount returns false.
+func (cs *ContractSet) RootCount(id types.FileContractID) (uint64, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return 0, false
+	}
+	return uint64(len(sc.MerkleRoots)), true
+}
+
+// WindowEnd returns the height at which the proof window of the specified
+// contract ends, according to its latest revision. The contract is not
+// locked. If the contract is not present
+// in the set, WindowEnd returns false.
+func (cs *ContractSet) WindowEnd(id types.FileContractID) (types.BlockHeight, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return 0, false
+	}
+	return sc.LastRevision.NewWindowEnd, true
+}
+
+// HostKey returns the public key of the host of the specified contract. The
+// contract is not locked. If the contract is not present in the set, HostKey
+// returns false.
+func (cs *ContractSet) HostKey(id types.FileContractID) (types.SiaPublicKey, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return types.SiaPublicKey{}, false
+	}
+	return sc.HostPublicKey, true
+}
+
+// RevisionNumber returns the revision number of the last revision of the
+// specified contract. The contract is not locked. If the contract is not
+// present in the set, RevisionNumber returns false.
+func (cs *ContractSet) RevisionNumber(id types.FileContractID) (uint64, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return 0, false
+	}
+	return sc.LastRevision.NewRevisionNumber, true
+}
+
+// QueueDepth returns the number of callers waiting to acquire the specified
+// contract, not counting the current holder. It returns 0 if the contract is
+// not present in the set.
+func (cs *ContractSet) QueueDepth(id types.FileContractID) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return 0
+	}
+	sc.mu.mu.Lock()
+	defer sc.mu.mu.Unlock()
+	return len(sc.mu.waiters)
+}
+
+// TotalRoots returns the sum of the number of Merkle roots in each contract.
+func (cs *ContractSet) TotalRoots() uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var total uint64
+	for _, sc := range cs.contracts {
+		total += uint64(len(sc.MerkleRoots))
+	}
+	return total
+}
+
+// TotalRenterFunds returns the sum of the funds remaining in each contract's
+// renter payout.
+func (cs *ContractSet) TotalRenterFunds() types.Currency {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	total := types.ZeroCurrency
+	for _, sc := range cs.contracts {
+		total = total.Add(sc.RenterFunds())
+	}
+	return total
+}
+
+// TotalSpent returns the sum of the download, storage, and upload spending of
+// each contract.
+func (cs *ContractSet) TotalSpent() types.Currency {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	total := types.ZeroCurrency
+	for _, sc := range cs.contracts {
+		total = total.Add(sc.DownloadSpending).Add(sc.StorageSpending).Add(sc.UploadSpending)
+	}
+	return total
+}
+
+// Utilization reports how much of the specified contract has been used: the
+// number of sectors stored, and the fraction of the renter's funds that have
+// been spent, where the renter's funds are the sum of the spending and the
+// remaining renter payout. If the contract is not present in the set, ok is
+// false.
+func (cs *ContractSet) Utilization(id types.FileContractID) (usedSectors uint64, fundsUsedFraction float64, ok bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return 0, 0, false
+	}
+	spent := sc.DownloadSpending.Add(sc.StorageSpending).Add(sc.UploadSpending)
+	total := spent.Add(sc.RenterFunds())
+	if !total.IsZero() {
+		fundsUsedFraction, _ = new(big.Rat).SetFrac(spent.Big(), total.Big()).Float64()
+	}
+	return uint64(len(sc.MerkleRoots)), fundsUsedFraction, true
+}
+
+// IsUsable reports whether the specified contract can be revised at the
+// given height. If it cannot, a human-readable reason is returned: "not
+// found", "no revision", "expired", or "no funds".
+func (cs *ContractSet) IsUsable(id types.FileContractID, height types.BlockHeight) (bool, string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	switch {
+	case !ok:
+		return false, "not found"
+	case len(sc.LastRevision.NewValidProofOutputs) != 2:
+		return false, "no revision"
+	case height >= sc.LastRevision.NewWindowEnd:
+		return false, "expired"
+	case sc.RenterFunds().IsZero():
+		return false, "no funds"
+	}
+	return true, ""
+}
+
+// RebalanceCandidates partitions the contracts in the set by their remaining
+// renter funds: low contains the contracts with less than minFunds, and high
+// contains the contracts with at least twice minFunds. Contracts in between
+// are in neither. Both slices are sorted by ID.
+func (cs *ContractSet) RebalanceCandidates(minFunds types.Currency) (low, high []types.FileContractID) {
+	cs.mu.Lock()
+	for id, sc := range cs.contracts {
+		funds := sc.RenterFunds()
+		if funds.Cmp(minFunds) < 0 {
+			low = append(low, id)
+		} else if funds.Cmp(minFunds.Mul64(2)) >= 0 {
+			high = append(high, id)
+		}
+	}
+	cs.mu.Unlock()
+	for _, ids := range [][]types.FileContractID{low, high} {
+		sort.Slice(ids, func(i, j int) bool {
+			return bytes.Compare(ids[i][:], ids[j][:]) < 0
+		})
+	}
+	return low, high
+}
+
+// SetStats summarizes the contracts in a ContractSet.
+type SetStats struct {
+	Contracts int
+	// TotalFunds is the sum of the spending and remaining renter payout of
+	// each contract; UsedFunds is the sum of the spending alone.
+	TotalFunds types.Currency
+	UsedFunds  types.Currency
+	Sectors    uint64
+	// EarliestWindowEnd and LatestWindowEnd are zero if the set is empty.
+	EarliestWindowEnd types.BlockHeight
+	LatestWindowEnd   types.BlockHeight
+	// HostContracts maps the string form of each host's public key to the
+	// number of contracts formed with that host.
+	HostContracts map[string]int
+}
+
+// Stats returns a summary of the contracts in the set, computed in a single
+// pass.
+func (cs *ContractSet) Stats() SetStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	stats := SetStats{
+		Contracts:     len(cs.contracts),
+		HostContracts: make(map[string]int),
+	}
+	first := true
+	for _, sc := range cs.contracts {
+		spent := sc.DownloadSpending.Add(sc.StorageSpending).Add(sc.UploadSpending)
+		stats.UsedFunds = stats.UsedFunds.Add(spent)
+		stats.TotalFunds = stats.TotalFunds.Add(spent).Add(sc.RenterFunds())
+		stats.Sectors += uint64(len(sc.MerkleRoots))
+		if end := sc.LastRevision.NewWindowEnd; first || end < stats.EarliestWindowEnd {
+			stats.EarliestWindowEnd = end
+		}
+		if end := sc.LastRevision.NewWindowEnd; end > stats.LatestWindowEnd {
+			stats.LatestWindowEnd = end
+		}
+		stats.HostContracts[sc.HostPublicKey.String()]++
+		first = false
+	}
+	return stats
+}
+
+// WriteMetrics writes metrics describing the set to w in the Prometheus text
+// exposition format. Funds are reported in hastings.
+func (cs *ContractSet) WriteMetrics(w io.Writer) error {
+	stats := cs.Stats()
+	metrics := []struct {
+		name, typ, help, value string
+	}{
+		{"sia_contractset_contracts", "gauge", "Number of contracts in the set.", strconv.Itoa(stats.Contracts)},
+		{"sia_contractset_total_funds_hastings", "gauge", "Sum of the spending and remaining renter funds of each contract.", stats.TotalFunds.String()},
+		{"sia_contractset_used_funds_hastings", "gauge", "Sum of the spending of each contract.", stats.UsedFunds.String()},
+		{"sia_contractset_sectors", "gauge", "Number of sectors stored across all contracts.", strconv.FormatUint(stats.Sectors, 10)},
+		{"sia_contractset_acquires_total", "counter", "Number of times a contract has been acquired.", strconv.FormatUint(atomic.LoadUint64(&cs.acquires), 10)},
+	}
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
 // Insert adds a new contract to the set. It panics if the contract is already
 // in the set.
 func (cs *ContractSet) Insert(contract modules.RenterContract) {
@@ -65,40 +658,262 @@ func (cs *ContractSet) Insert(contract modules.RenterContract) {
 	if _, ok := cs.contracts[contract.ID]; ok {
 		build.Critical("contract already in set")
 	}
-	cs.contracts[contract.ID] = &safeContract{RenterContract: contract}
+	cs.contracts[contract.ID] = newSafeContract(contract)
+	cs.notify(contract)
 }
 
 // Acquire looks up the contract with the specified FileContractID and locks
-// it before returning it. If the contract is not present in the set, Acquire
-// returns false and a zero-valued RenterContract.
+// it before returning it. If the contract is not present in the set, or its
+// lock is not acquired within AcquireTimeout, Acquire returns false and a
+// zero-valued RenterContract.
 func (cs *ContractSet) Acquire(id types.FileContractID) (modules.RenterContract, bool) {
+	if cs.AcquireTimeout == 0 {
+		return cs.AcquireCancel(id, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cs.AcquireTimeout)
+	defer cancel()
+	return cs.AcquireCtx(ctx, id)
+}
+
+// AcquireCancel is like Acquire, but gives up waiting for the contract's lock
+// if cancel is closed, returning false and a zero-valued RenterContract.
+func (cs *ContractSet) AcquireCancel(id types.FileContractID, cancel <-chan struct{}) (modules.RenterContract, bool) {
+	cs.mu.Lock()
+	sc, ok := cs.contracts[id]
+	cs.mu.Unlock()
+	if !ok || !sc.mu.lock(cancel) || cs.releaseDeleted(sc, false) {
+		return modules.RenterContract{}, false
+	}
+	atomic.AddUint64(&cs.acquires, 1)
+	return sc.RenterContract, true
+}
+
+// releaseDeleted reports whether sc was removed from the set while the caller
+// was waiting for its lock, which the caller has just acquired. If so, the
+// lock is released, passing it on to the next waiter.
+func (cs *ContractSet) releaseDeleted(sc *safeContract, shared bool) bool {
+	cs.mu.Lock()
+	deleted := sc.deleted
+	cs.mu.Unlock()
+	if deleted && shared {
+		sc.mu.runlock()
+	} else if deleted {
+		sc.mu.unlock()
+	}
+	return deleted
+}
+
+// traceIDKey is the context key under which WithTraceID stores a trace ID.
+type traceIDKey struct{}
+
+// WithTraceID returns a copy of ctx that carries traceID, identifying the
+// request on whose behalf contracts are acquired with AcquireCtx.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// AcquireCtx is like AcquireCancel, but gives up waiting for the contract's
+// lock when ctx is done. If ctx carries a trace ID (see WithTraceID), it is
+// reported by LongHeldLocks as the holder of the contract.
+func (cs *ContractSet) AcquireCtx(ctx context.Context, id types.FileContractID) (modules.RenterContract, bool) {
+	cs.mu.Lock()
+	sc, ok := cs.contracts[id]
+	cs.mu.Unlock()
+	if !ok || !sc.mu.lock(ctx.Done()) || cs.releaseDeleted(sc, false) {
+		return modules.RenterContract{}, false
+	}
+	atomic.AddUint64(&cs.acquires, 1)
+	if traceID, ok := ctx.Value(traceIDKey{}).(string); ok {
+		sc.mu.setTraceID(traceID)
+	}
+	return sc.RenterContract, true
+}
+
+// AcquirePriority is like Acquire, but if the contract is held, the caller
+// is granted it ahead of any waiters with a lower priority than prio. Waiters
+// with equal priority are granted the contract in the order they arrived;
+// Acquire and the other Acquire methods use priority 0.
+func (cs *ContractSet) AcquirePriority(id types.FileContractID, prio int) (modules.RenterContract, bool) {
+	cs.mu.Lock()
+	sc, ok := cs.contracts[id]
+	cs.mu.Unlock()
+	if !ok || !sc.mu.lockPriority(prio, nil) || cs.releaseDeleted(sc, false) {
+		return modules.RenterContract{}, false
+	}
+	atomic.AddUint64(&cs.acquires, 1)
+	return sc.RenterContract, true
+}
+
+// AcquireUnsafe is like Acquire, but does not lock the set while looking up
+// the contract, avoiding the overhead of doing so in tight loops. It is only
+// safe to call if no other goroutine is using the set concurrently, e.g. during
+// bulk operations that already have exclusive access to it. The contract's own
+// lock is still acquired, and the contract must be released with Return as
+// usual.
+func (cs *ContractSet) AcquireUnsafe(id types.FileContractID) (modules.RenterContract, bool) {
+	sc, ok := cs.contracts[id]
+	if !ok || !sc.mu.lock(nil) {
+		return modules.RenterContract{}, false
+	}
+	atomic.AddUint64(&cs.acquires, 1)
+	return sc.RenterContract, true
+}
+
+// AcquireRead is like Acquire, but acquires the contract for reading only.
+// Any number of readers may hold a contract at once, but not while it is
+// acquired by Acquire. The returned contract must not be modified, and must
+// be released with ReturnRead rather than Return; it must not be used after
+// it is released.
+func (cs *ContractSet) AcquireRead(id types.FileContractID) (modules.RenterContract, bool) {
 	cs.mu.Lock()
 	sc, ok := cs.contracts[id]
 	cs.mu.Unlock()
-	if ok {
-		sc.mu.Lock()
+	if !ok || !sc.mu.rlock(nil) || cs.releaseDeleted(sc, true) {
+		return modules.RenterContract{}, false
+	}
+	atomic.AddUint64(&cs.acquires, 1)
+	return sc.RenterContract, true
+}
+
+// ReturnRead releases a contract acquired by AcquireRead. If the contract is
+// not present in the set, ReturnRead is a no-op.
+func (cs *ContractSet) ReturnRead(id types.FileContractID) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sc, ok := cs.contracts[id]
+	if !ok {
+		return
+	}
+	sc.mu.runlock()
+}
+
+// AcquireVerified is like Acquire, but additionally verifies that the
+// contract's MerkleRoots match the Merkle root of its last revision. If they
+// do not, the contract is returned to the set and ErrMerkleRootMismatch is
+// returned. Since verification takes time proportional to the number of
+// roots, Acquire should be preferred unless corruption is suspected.
+func (cs *ContractSet) AcquireVerified(id types.FileContractID) (modules.RenterContract, error) {
+	c, ok := cs.Acquire(id)
+	if !ok && cs.Has(id) {
+		return modules.RenterContract{}, ErrAcquireTimeout
+	} else if !ok {
+		return modules.RenterContract{}, ErrContractNotFound
+	}
+	if cachedMerkleRoot(c.MerkleRoots) != c.LastRevision.NewFileMerkleRoot {
+		cs.Return(c)
+		return modules.RenterContract{}, ErrMerkleRootMismatch
 	}
-	return sc.RenterContract, ok
+	return c, nil
+}
+
+// AcquireMany looks up and locks each of the specified contracts. To prevent
+// deadlock between concurrent callers, the contracts are locked in order of
+// their FileContractIDs, and are returned in that order; duplicate IDs are
+// ignored. If any contract is not present in the set, AcquireMany returns
+// any contracts it already acquired to the set and returns false.
+func (cs *ContractSet) AcquireMany(ids []types.FileContractID) ([]modules.RenterContract, bool) {
+	sorted := append([]types.FileContractID(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	contracts := make([]modules.RenterContract, 0, len(sorted))
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		c, ok := cs.Acquire(id)
+		if !ok {
+			cs.ReturnMany(contracts)
+			return nil, false
+		}
+		contracts = append(contracts, c)
+	}
+	return contracts, true
 }
 
 // Return returns a locked contract to the set and unlocks it. The contract
 // must have been previously acquired by Acquire. If the contract is not
 // present in the set, Return panics.
 func (cs *ContractSet) Return(contract modules.RenterContract) {
+	if err := cs.ReturnErr(contract); err != nil {
+		build.Critical(err)
+	}
+}
+
+// ReturnErr is like Return, but returns ErrContractNotFound instead of
+// panicking if the contract is not present in the set.
+func (cs *ContractSet) ReturnErr(contract modules.RenterContract) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	sc, ok := cs.contracts[contract.ID]
 	if !ok {
-		build.Critical("no contract with that id")
+		return ErrContractNotFound
 	}
 	sc.RenterContract = contract
 	cs.contracts[contract.ID] = sc
-	sc.mu.Unlock()
+	cs.notify(contract)
+	sc.mu.unlock()
+	return nil
+}
+
+// ReturnMany returns each of the locked contracts to the set, as if by
+// calling Return on each. The contracts must have been previously acquired
+// by AcquireMany.
+func (cs *ContractSet) ReturnMany(contracts []modules.RenterContract) {
+	for _, c := range contracts {
+		cs.Return(c)
+	}
+}
+
+// WithContract acquires the contract with the specified FileContractID,
+// calls fn on it, and returns it to the set, even if fn panics. Any changes fn
+// makes to the contract are kept. fn's error is returned; if the contract
+// cannot be acquired, ErrContractNotFound or ErrAcquireTimeout is returned
+// instead and fn is not called.
+func (cs *ContractSet) WithContract(id types.FileContractID, fn func(*modules.RenterContract) error) error {
+	c, ok := cs.Acquire(id)
+	if !ok && cs.Has(id) {
+		return ErrAcquireTimeout
+	} else if !ok {
+		return ErrContractNotFound
+	}
+	defer func() { cs.Return(c) }()
+	return fn(&c)
+}
+
+// Sweep acquires each contract in the set in turn, in order of their
+// FileContractIDs, and calls fn on it before returning it to the set. Any
+// changes fn makes to the contract are kept, even if fn returns an error.
+// Contracts that are deleted before Sweep reaches them are skipped, and those
+// that cannot be acquired within AcquireTimeout are reported as
+// ErrAcquireTimeout. Only one contract is held at a time. The errors are
+// combined into a single error.
+func (cs *ContractSet) Sweep(fn func(*modules.RenterContract) error) error {
+	ids := cs.IDs()
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	var errs []error
+	for _, id := range ids {
+		c, ok := cs.Acquire(id)
+		if !ok && cs.Has(id) {
+			errs = append(errs, ErrAcquireTimeout)
+			continue
+		} else if !ok {
+			continue
+		}
+		if err := fn(&c); err != nil {
+			errs = append(errs, err)
+		}
+		cs.Return(c)
+	}
+	return build.ComposeErrors(errs...)
 }
 
 // Delete removes a contract from the set. The contract must have been
-// previously acquired by Acquire. If the contract is not present in the set,
-// Delete is a no-op.
+// previously acquired by Acquire. Goroutines waiting to acquire the contract
+// give up and report that it is not present. If the contract is not present
+// in the set, Delete is a no-op.
 func (cs *ContractSet) Delete(contract modules.RenterContract) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
@@ -107,17 +922,392 @@ func (cs *ContractSet) Delete(contract modules.RenterContract) {
 		return
 	}
 	delete(cs.contracts, contract.ID)
-	sc.mu.Unlock()
+	sc.deleted = true
+	sc.mu.unlock()
+}
+
+// GC removes from the set each contract whose proof window has ended as of
+// height and that has no remaining renter funds, returning their IDs in
+// sorted order. Contracts that are currently acquired are skipped, so GC is
+// safe to call while the set is in use; they will be collected by a later
+// call.
+func (cs *ContractSet) GC(height types.BlockHeight) []types.FileContractID {
+	cs.mu.Lock()
+	var ids []types.FileContractID
+	for id, sc := range cs.contracts {
+		if height < sc.LastRevision.NewWindowEnd || !sc.RenterFunds().IsZero() || !sc.mu.tryLock() {
+			continue
+		}
+		delete(cs.contracts, id)
+		sc.deleted = true
+		sc.mu.unlock()
+		ids = append(ids, id)
+	}
+	cs.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// A LockInfo describes a contract that is currently acquired.
+type LockInfo struct {
+	ID      types.FileContractID
+	HeldFor time.Duration
+	// Stack is the stack trace of the goroutine that acquired the contract.
+	Stack string
+	// TraceID is the trace ID of the context passed to AcquireCtx, if any.
+	TraceID string
+}
+
+// LongHeldLocks returns the contracts that have been acquired for longer
+// than threshold, sorted by ID, to help find callers that fail to return
+// contracts. Since recording the acquiring stack is expensive, acquisitions
+// are only tracked in debug builds; otherwise, LongHeldLocks returns nil.
+func (cs *ContractSet) LongHeldLocks(threshold time.Duration) []LockInfo {
+	if !build.DEBUG {
+		return nil
+	}
+	cs.mu.Lock()
+	var infos []LockInfo
+	for id, sc := range cs.contracts {
+		sc.mu.mu.Lock()
+		if sc.mu.locked && !sc.mu.lockedAt.IsZero() {
+			if held := time.Since(sc.mu.lockedAt); held > threshold {
+				infos = append(infos, LockInfo{
+					ID:      id,
+					HeldFor: held,
+					Stack:   string(sc.mu.stack),
+					TraceID: sc.mu.traceID,
+				})
+			}
+		}
+		sc.mu.mu.Unlock()
+	}
+	cs.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return bytes.Compare(infos[i].ID[:], infos[j].ID[:]) < 0
+	})
+	return infos
+}
+
+// subscriberBuffer is the number of updates buffered for each subscriber.
+const subscriberBuffer = 64
+
+// Subscribe returns a channel that receives a copy of each contract inserted
+// into or returned to the set, sans MerkleRoots, along with a function that
+// unsubscribes and closes the channel. Each subscriber has its own channel,
+// which buffers up to subscriberBuffer updates; if the buffer is full, further
+// updates are dropped rather than blocking the set, so a slow subscriber
+// should treat an update as a prompt to re-examine the set rather than as a
+// complete log of changes.
+func (cs *ContractSet) Subscribe() (<-chan modules.RenterContract, func()) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ch := make(chan modules.RenterContract, subscriberBuffer)
+	if cs.subscribers == nil {
+		cs.subscribers = make(map[chan modules.RenterContract]struct{})
+	}
+	cs.subscribers[ch] = struct{}{}
+	return ch, func() {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		if _, ok := cs.subscribers[ch]; ok {
+			delete(cs.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// notify sends c, sans MerkleRoots, to each subscriber that has room for it.
+// cs.mu must be held.
+func (cs *ContractSet) notify(c modules.RenterContract) {
+	c.MerkleRoots = nil
+	for ch := range cs.subscribers {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// Clone returns a deep copy of the set, such that modifying the contracts in
+// either set does not affect the other. The contracts in the clone are
+// unlocked, regardless of whether they are locked in the original set.
+func (cs *ContractSet) Clone() ContractSet {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	contracts := make([]modules.RenterContract, 0, len(cs.contracts))
+	for _, sc := range cs.contracts {
+		contracts = append(contracts, copyContract(sc.RenterContract))
+	}
+	return newContractSet(contracts, cs.AcquireTimeout)
+}
+
+// copyContract returns a deep copy of c.
+func copyContract(c modules.RenterContract) modules.RenterContract {
+	// the fields are copied explicitly rather than by encoding round-trip,
+	// since the roots of a large contract exceed encoding.MaxSliceSize
+	cp := c
+	cp.FileContract.ValidProofOutputs = copyOutputs(c.FileContract.ValidProofOutputs)
+	cp.FileContract.MissedProofOutputs = copyOutputs(c.FileContract.MissedProofOutputs)
+	cp.HostPublicKey.Key = copyBytes(c.HostPublicKey.Key)
+	cp.LastRevision = copyRevision(c.LastRevision)
+	cp.LastRevisionTxn = copyRevisionTxn(c.LastRevisionTxn)
+	if c.MerkleRoots != nil {
+		cp.MerkleRoots = append(modules.MerkleRootSet(nil), c.MerkleRoots...)
+	}
+	return cp
+}
+
+// copyRevision returns a deep copy of rev.
+func copyRevision(rev types.FileContractRevision) types.FileContractRevision {
+	cp := rev
+	cp.NewValidProofOutputs = copyOutputs(rev.NewValidProofOutputs)
+	cp.NewMissedProofOutputs = copyOutputs(rev.NewMissedProofOutputs)
+	if rev.UnlockConditions.PublicKeys != nil {
+		cp.UnlockConditions.PublicKeys = make([]types.SiaPublicKey, len(rev.UnlockConditions.PublicKeys))
+		for i, pk := range rev.UnlockConditions.PublicKeys {
+			cp.UnlockConditions.PublicKeys[i] = types.SiaPublicKey{Algorithm: pk.Algorithm, Key: copyBytes(pk.Key)}
+		}
+	}
+	return cp
+}
+
+// copyRevisionTxn returns a deep copy of the revisions and signatures of txn,
+// which are the only fields of a revision transaction. Any other fields are
+// shared with txn.
+func copyRevisionTxn(txn types.Transaction) types.Transaction {
+	cp := txn
+	if txn.FileContractRevisions != nil {
+		cp.FileContractRevisions = make([]types.FileContractRevision, len(txn.FileContractRevisions))
+		for i, rev := range txn.FileContractRevisions {
+			cp.FileContractRevisions[i] = copyRevision(rev)
+		}
+	}
+	if txn.TransactionSignatures != nil {
+		cp.TransactionSignatures = make([]types.TransactionSignature, len(txn.TransactionSignatures))
+		for i, sig := range txn.TransactionSignatures {
+			sig.Signature = copyBytes(sig.Signature)
+			cf := &sig.CoveredFields
+			for _, indices := range []*[]uint64{
+				&cf.SiacoinInputs, &cf.SiacoinOutputs, &cf.FileContracts,
+				&cf.FileContractRevisions, &cf.StorageProofs, &cf.SiafundInputs,
+				&cf.SiafundOutputs, &cf.MinerFees, &cf.ArbitraryData,
+				&cf.TransactionSignatures,
+			} {
+				*indices = copyIndices(*indices)
+			}
+			cp.TransactionSignatures[i] = sig
+		}
+	}
+	return cp
+}
+
+// copyOutputs returns a copy of outputs, preserving nil.
+func copyOutputs(outputs []types.SiacoinOutput) []types.SiacoinOutput {
+	if outputs == nil {
+		return nil
+	}
+	return append([]types.SiacoinOutput(nil), outputs...)
+}
+
+// copyBytes returns a copy of b, preserving nil.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// copyIndices returns a copy of indices, preserving nil.
+func copyIndices(indices []uint64) []uint64 {
+	if indices == nil {
+		return nil
+	}
+	return append([]uint64(nil), indices...)
+}
+
+// A SetSnapshot is a copy of the contracts in a ContractSet at a point in
+// time. It is unaffected by later changes to the set.
+type SetSnapshot struct {
+	contracts map[types.FileContractID]modules.RenterContract
+}
+
+// Snapshot returns a deep copy of the contracts currently in the set.
+func (cs *ContractSet) Snapshot() SetSnapshot {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	snap := SetSnapshot{
+		contracts: make(map[types.FileContractID]modules.RenterContract, len(cs.contracts)),
+	}
+	for id, sc := range cs.contracts {
+		snap.contracts[id] = copyContract(sc.RenterContract)
+	}
+	return snap
+}
+
+// A ContractDiff describes how a contract changed between two snapshots.
+type ContractDiff struct {
+	ID                types.FileContractID
+	OldRevisionNumber uint64
+	NewRevisionNumber uint64
+	OldRenterFunds    types.Currency
+	NewRenterFunds    types.Currency
+}
+
+// A SetDiff lists the contracts that were added to, removed from, or
+// modified in a set between two snapshots. Each list is sorted by ID.
+type SetDiff struct {
+	Added    []types.FileContractID
+	Removed  []types.FileContractID
+	Modified []ContractDiff
+}
+
+// Diff reports the changes from snapshot a to snapshot b. A contract is
+// considered modified if its revision number or renter funds differ.
+func Diff(a, b SetSnapshot) SetDiff {
+	var d SetDiff
+	for id, old := range a.contracts {
+		c, ok := b.contracts[id]
+		if !ok {
+			d.Removed = append(d.Removed, id)
+			continue
+		}
+		oldFunds, newFunds := old.RenterFunds(), c.RenterFunds()
+		if old.LastRevision.NewRevisionNumber != c.LastRevision.NewRevisionNumber || oldFunds.Cmp(newFunds) != 0 {
+			d.Modified = append(d.Modified, ContractDiff{
+				ID:                id,
+				OldRevisionNumber: old.LastRevision.NewRevisionNumber,
+				NewRevisionNumber: c.LastRevision.NewRevisionNumber,
+				OldRenterFunds:    oldFunds,
+				NewRenterFunds:    newFunds,
+			})
+		}
+	}
+	for id := range b.contracts {
+		if _, ok := a.contracts[id]; !ok {
+			d.Added = append(d.Added, id)
+		}
+	}
+	for _, ids := range [][]types.FileContractID{d.Added, d.Removed} {
+		sort.Slice(ids, func(i, j int) bool {
+			return bytes.Compare(ids[i][:], ids[j][:]) < 0
+		})
+	}
+	sort.Slice(d.Modified, func(i, j int) bool {
+		return bytes.Compare(d.Modified[i].ID[:], d.Modified[j].ID[:]) < 0
+	})
+	return d
+}
+
+// WriteTo writes every contract in the set, including its Merkle roots and
+// secret key, to w. The contracts are written as a count followed by, for
+// each contract, a length-prefixed object holding everything but its Merkle
+// roots, and then the roots themselves, preceded by their count. Streaming
+// the roots separately keeps large contracts within the limits of
+// encoding.ReadObject. The set can be restored with ReadContractSet. The
+// contracts are not locked.
+func (cs *ContractSet) WriteTo(w io.Writer) (int64, error) {
+	cs.mu.Lock()
+	contracts := make([]modules.RenterContract, 0, len(cs.contracts))
+	for _, sc := range cs.contracts {
+		contracts = append(contracts, sc.RenterContract)
+	}
+	cs.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	if err := encoding.WriteUint64(bw, uint64(len(contracts))); err != nil {
+		return 0, err
+	}
+	n := int64(8)
+	for _, c := range contracts {
+		roots := c.MerkleRoots
+		c.MerkleRoots = nil
+		b := encoding.Marshal(c)
+		if err := encoding.WritePrefix(bw, b); err != nil {
+			return n, err
+		}
+		n += 8 + int64(len(b))
+		if err := encoding.WriteUint64(bw, uint64(len(roots))); err != nil {
+			return n, err
+		}
+		n += 8
+		for _, root := range roots {
+			if _, err := bw.Write(root[:]); err != nil {
+				return n, err
+			}
+			n += crypto.HashSize
+		}
+	}
+	return n, bw.Flush()
+}
+
+// rootBatchSize is the number of Merkle roots that ReadContractSet reads at
+// once.
+const rootBatchSize = 4096
+
+// ReadContractSet reads a set of contracts previously written by
+// ContractSet.WriteTo and returns them as a new ContractSet.
+func ReadContractSet(r io.Reader) (ContractSet, error) {
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return ContractSet{}, err
+	}
+	numContracts := encoding.DecUint64(prefix)
+	var contracts []modules.RenterContract
+	for i := uint64(0); i < numContracts; i++ {
+		var c modules.RenterContract
+		if err := encoding.ReadObject(r, &c, encoding.MaxObjectSize); err != nil {
+			return ContractSet{}, err
+		}
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return ContractSet{}, err
+		}
+		// the roots are read in batches, rather than allocated up front, so
+		// that a corrupt count cannot exhaust memory
+		numRoots := encoding.DecUint64(prefix)
+		buf := make([]byte, rootBatchSize*crypto.HashSize)
+		for numRoots > 0 {
+			batch := numRoots
+			if batch > rootBatchSize {
+				batch = rootBatchSize
+			}
+			if _, err := io.ReadFull(r, buf[:batch*crypto.HashSize]); err != nil {
+				return ContractSet{}, err
+			}
+			for j := uint64(0); j < batch; j++ {
+				var root crypto.Hash
+				copy(root[:], buf[j*crypto.HashSize:])
+				c.MerkleRoots = append(c.MerkleRoots, root)
+			}
+			numRoots -= batch
+		}
+		contracts = append(contracts, c)
+	}
+	return NewContractSet(contracts), nil
 }
 
 // NewContractSet returns a ContractSet populated with the provided slice of
-// RenterContracts, which may be nil.
+// RenterContracts, which may be nil. If multiple contracts share an ID (e.g.
+// after restoring overlapping backups), the one with the highest revision
+// number is kept.
 func NewContractSet(contracts []modules.RenterContract) ContractSet {
+	return newContractSet(contracts, 0)
+}
+
+// newContractSet is like NewContractSet, but additionally sets the
+// AcquireTimeout of the returned set.
+func newContractSet(contracts []modules.RenterContract, acquireTimeout time.Duration) ContractSet {
 	set := make(map[types.FileContractID]*safeContract)
 	for _, c := range contracts {
-		set[c.ID] = &safeContract{RenterContract: c}
+		if sc, ok := set[c.ID]; ok && sc.LastRevision.NewRevisionNumber >= c.LastRevision.NewRevisionNumber {
+			continue
+		}
+		set[c.ID] = newSafeContract(c)
 	}
 	return ContractSet{
-		contracts: set,
+		contracts:      set,
+		AcquireTimeout: acquireTimeout,
 	}
 }
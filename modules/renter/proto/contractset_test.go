@@ -1,10 +1,20 @@
 package proto
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
 	"github.com/NebulousLabs/Sia/modules"
 	"github.com/NebulousLabs/Sia/types"
 
@@ -32,6 +42,10 @@ func TestContractSet(t *testing.T) {
 		{ID: id2},
 	})
 
+	if !cs.Has(id1) || cs.Has(types.FileContractID{3}) {
+		t.Fatal("Has returned wrong result")
+	}
+
 	// uncontested acquire/release
 	c1 := cs.mustAcquire(t, id1)
 	cs.Return(c1)
@@ -73,6 +87,7 @@ func TestContractSet(t *testing.T) {
 	funcs := []func(){
 		func() { cs.Len() },
 		func() { cs.IDs() },
+		func() { cs.Has(id1) },
 		func() { cs.Contracts() },
 		func() { cs.Return(cs.mustAcquire(t, id1)) },
 		func() { cs.Return(cs.mustAcquire(t, id2)) },
@@ -95,3 +110,1298 @@ func TestContractSet(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestContractSetSerializationLarge tests that a contract whose roots exceed
+// encoding.MaxObjectSize can be written and read back.
+func TestContractSetSerializationLarge(t *testing.T) {
+	c := modules.RenterContract{
+		ID:          types.FileContractID{1},
+		MerkleRoots: make(modules.MerkleRootSet, 400e3),
+	}
+	for i := range c.MerkleRoots {
+		c.MerkleRoots[i] = crypto.Hash{byte(i), byte(i >> 8), byte(i >> 16)}
+	}
+	cs := NewContractSet([]modules.RenterContract{c})
+
+	var buf bytes.Buffer
+	n, err := cs.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %v bytes, but wrote %v", n, buf.Len())
+	} else if n <= encoding.MaxObjectSize {
+		t.Fatal("contract is not larger than MaxObjectSize:", n)
+	}
+	cs2, err := ReadContractSet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := cs2.mustAcquire(t, c.ID)
+	defer cs2.Return(c2)
+	if !reflect.DeepEqual(c2.MerkleRoots, c.MerkleRoots) {
+		t.Fatal("roots were not read back correctly")
+	}
+}
+
+// TestContractSetSerialization tests that a ContractSet survives a round trip
+// through WriteTo and ReadContractSet.
+func TestContractSetSerialization(t *testing.T) {
+	sk, _ := crypto.GenerateKeyPair()
+	contracts := make([]modules.RenterContract, 3)
+	for i := range contracts {
+		contracts[i] = modules.RenterContract{
+			ID:          types.FileContractID{byte(i)},
+			MerkleRoots: modules.MerkleRootSet{{byte(i)}, {byte(i + 1)}},
+			SecretKey:   sk,
+		}
+		contracts[i].LastRevision.NewRevisionNumber = uint64(i) * 7
+	}
+	cs := NewContractSet(contracts)
+
+	var buf bytes.Buffer
+	n, err := cs.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %v bytes, but wrote %v", n, buf.Len())
+	}
+	cs2, err := ReadContractSet(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs2.Len() != cs.Len() {
+		t.Fatalf("expected %v contracts, got %v", cs.Len(), cs2.Len())
+	}
+	for _, c := range contracts {
+		c2 := cs2.mustAcquire(t, c.ID)
+		cs2.Return(c2)
+		if c2.LastRevision.NewRevisionNumber != c.LastRevision.NewRevisionNumber {
+			t.Error("revision number mismatch:", c2.LastRevision.NewRevisionNumber, c.LastRevision.NewRevisionNumber)
+		}
+		if len(c2.MerkleRoots) != len(c.MerkleRoots) {
+			t.Fatal("Merkle root count mismatch:", len(c2.MerkleRoots), len(c.MerkleRoots))
+		}
+		for i := range c.MerkleRoots {
+			if c2.MerkleRoots[i] != c.MerkleRoots[i] {
+				t.Error("Merkle root mismatch at index", i)
+			}
+		}
+		if c2.SecretKey != c.SecretKey {
+			t.Error("secret key mismatch")
+		}
+	}
+}
+
+// TestContractSetDuplicates tests that NewContractSet keeps the most recent
+// revision of contracts that share an ID.
+func TestContractSetDuplicates(t *testing.T) {
+	id := types.FileContractID{1}
+	var contracts []modules.RenterContract
+	for _, n := range []uint64{3, 7, 5} {
+		c := modules.RenterContract{ID: id}
+		c.LastRevision.NewRevisionNumber = n
+		contracts = append(contracts, c)
+	}
+	cs := NewContractSet(contracts)
+	if cs.Len() != 1 {
+		t.Fatal("expected 1 contract, got", cs.Len())
+	}
+	c := cs.mustAcquire(t, id)
+	defer cs.Return(c)
+	if c.LastRevision.NewRevisionNumber != 7 {
+		t.Fatal("expected most recent revision to be kept, got", c.LastRevision.NewRevisionNumber)
+	}
+}
+
+// TestContractSetCloneLarge tests that Clone copies contracts whose roots
+// exceed encoding.MaxSliceSize.
+func TestContractSetCloneLarge(t *testing.T) {
+	c := modules.RenterContract{
+		ID:          types.FileContractID{1},
+		MerkleRoots: make(modules.MerkleRootSet, 160e3),
+	}
+	c.MerkleRoots[len(c.MerkleRoots)-1] = crypto.Hash{1}
+	c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{{Value: types.NewCurrency64(100)}, {}}
+	cs := NewContractSet([]modules.RenterContract{c})
+	clone := cs.Clone()
+
+	c2 := clone.mustAcquire(t, c.ID)
+	defer clone.Return(c2)
+	if len(c2.MerkleRoots) != len(c.MerkleRoots) || c2.MerkleRoots[len(c2.MerkleRoots)-1] != (crypto.Hash{1}) {
+		t.Fatal("clone has wrong roots:", len(c2.MerkleRoots))
+	} else if !c2.LastRevision.NewValidProofOutputs[0].Value.Equals64(100) {
+		t.Fatal("clone has wrong revision")
+	}
+}
+
+// TestContractSetClone tests that a cloned ContractSet is independent of the
+// original.
+func TestContractSetClone(t *testing.T) {
+	c := modules.RenterContract{
+		ID:          types.FileContractID{1},
+		MerkleRoots: modules.MerkleRootSet{{1}, {2}},
+	}
+	c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{{Value: types.NewCurrency64(100)}}
+	cs := NewContractSet([]modules.RenterContract{c})
+	// a locked contract should still be cloned
+	cs.mustAcquire(t, c.ID)
+	clone := cs.Clone()
+	cs.Return(c)
+
+	c2 := clone.mustAcquire(t, c.ID)
+	if !reflect.DeepEqual(c2.MerkleRoots, c.MerkleRoots) || !c2.LastRevision.NewValidProofOutputs[0].Value.Equals(c.LastRevision.NewValidProofOutputs[0].Value) {
+		t.Fatal("clone does not match original")
+	}
+	// modifying the clone should not affect the original
+	c2.MerkleRoots[0] = crypto.Hash{3}
+	c2.LastRevision.NewValidProofOutputs[0].Value = types.ZeroCurrency
+	c2.MerkleRoots = append(c2.MerkleRoots, crypto.Hash{4})
+	clone.Return(c2)
+	c1 := cs.mustAcquire(t, c.ID)
+	defer cs.Return(c1)
+	if c1.MerkleRoots[0] != (crypto.Hash{1}) || len(c1.MerkleRoots) != 2 || c1.LastRevision.NewValidProofOutputs[0].Value.IsZero() {
+		t.Fatal("modifying clone affected original")
+	}
+}
+
+// TestContractSetRootCount tests the RootCount and TotalRoots methods.
+func TestContractSetRootCount(t *testing.T) {
+	id1, id2 := types.FileContractID{1}, types.FileContractID{2}
+	cs := NewContractSet([]modules.RenterContract{{ID: id1}, {ID: id2}})
+	if cs.TotalRoots() != 0 {
+		t.Fatal("expected no roots")
+	}
+
+	// simulate uploading sectors to each contract
+	for i, id := range []types.FileContractID{id1, id2, id2} {
+		c := cs.mustAcquire(t, id)
+		c.MerkleRoots = append(c.MerkleRoots, crypto.Hash{byte(i)})
+		cs.Return(c)
+	}
+	if n, ok := cs.RootCount(id1); !ok || n != 1 {
+		t.Fatal("expected 1 root, got", n, ok)
+	} else if n, ok := cs.RootCount(id2); !ok || n != 2 {
+		t.Fatal("expected 2 roots, got", n, ok)
+	} else if _, ok := cs.RootCount(types.FileContractID{3}); ok {
+		t.Fatal("RootCount should fail for a missing contract")
+	} else if cs.TotalRoots() != 3 {
+		t.Fatal("expected 3 total roots, got", cs.TotalRoots())
+	}
+}
+
+// TestContractSetHeaderFields tests the WindowEnd, HostKey, and
+// RevisionNumber methods, including while the contract is acquired.
+func TestContractSetHeaderFields(t *testing.T) {
+	_, pk := crypto.GenerateKeyPair()
+	c := modules.RenterContract{
+		ID:            types.FileContractID{1},
+		HostPublicKey: types.Ed25519PublicKey(pk),
+	}
+	c.LastRevision.NewWindowEnd = 100
+	c.LastRevision.NewRevisionNumber = 7
+	cs := NewContractSet([]modules.RenterContract{c})
+
+	// the accessors must not block on an acquired contract
+	held := cs.mustAcquire(t, c.ID)
+	defer cs.Return(held)
+	if end, ok := cs.WindowEnd(c.ID); !ok || end != 100 {
+		t.Fatal("expected window end 100, got", end, ok)
+	} else if key, ok := cs.HostKey(c.ID); !ok || key.String() != c.HostPublicKey.String() {
+		t.Fatal("wrong host key:", key, ok)
+	} else if n, ok := cs.RevisionNumber(c.ID); !ok || n != 7 {
+		t.Fatal("expected revision number 7, got", n, ok)
+	}
+
+	missing := types.FileContractID{2}
+	if _, ok := cs.WindowEnd(missing); ok {
+		t.Fatal("WindowEnd should fail for a missing contract")
+	} else if _, ok := cs.HostKey(missing); ok {
+		t.Fatal("HostKey should fail for a missing contract")
+	} else if _, ok := cs.RevisionNumber(missing); ok {
+		t.Fatal("RevisionNumber should fail for a missing contract")
+	}
+}
+
+// TestContractSetTotals tests the TotalRenterFunds and TotalSpent methods.
+func TestContractSetTotals(t *testing.T) {
+	var contracts []modules.RenterContract
+	for i := 0; i < 3; i++ {
+		c := modules.RenterContract{
+			ID:               types.FileContractID{byte(i)},
+			DownloadSpending: types.NewCurrency64(1),
+			StorageSpending:  types.NewCurrency64(2),
+			UploadSpending:   types.NewCurrency64(3),
+		}
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(uint64(i) * 100)},
+			{Value: types.NewCurrency64(1000)},
+		}
+		contracts = append(contracts, c)
+	}
+	cs := NewContractSet(contracts)
+	if funds := cs.TotalRenterFunds(); !funds.Equals(types.NewCurrency64(300)) {
+		t.Error("expected 300 renter funds, got", funds)
+	}
+	if spent := cs.TotalSpent(); !spent.Equals(types.NewCurrency64(18)) {
+		t.Error("expected 18 spent, got", spent)
+	}
+
+	empty := NewContractSet(nil)
+	if !empty.TotalRenterFunds().IsZero() || !empty.TotalSpent().IsZero() {
+		t.Error("expected empty set to have zero totals")
+	}
+}
+
+// TestContractSetIsUsable tests the IsUsable method.
+func TestContractSetIsUsable(t *testing.T) {
+	newContract := func(id byte, funds uint64) modules.RenterContract {
+		c := modules.RenterContract{ID: types.FileContractID{id}}
+		c.LastRevision.NewWindowEnd = 100
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(funds)},
+			{Value: types.ZeroCurrency},
+		}
+		return c
+	}
+	good, broke := newContract(1, 10), newContract(2, 0)
+	norev := modules.RenterContract{ID: types.FileContractID{3}}
+	cs := NewContractSet([]modules.RenterContract{good, broke, norev})
+
+	tests := []struct {
+		id     types.FileContractID
+		height types.BlockHeight
+		usable bool
+		reason string
+	}{
+		{good.ID, 99, true, ""},
+		{good.ID, 100, false, "expired"},
+		{broke.ID, 0, false, "no funds"},
+		{norev.ID, 0, false, "no revision"},
+		{types.FileContractID{4}, 0, false, "not found"},
+	}
+	for _, test := range tests {
+		usable, reason := cs.IsUsable(test.id, test.height)
+		if usable != test.usable || reason != test.reason {
+			t.Errorf("IsUsable(%v, %v): expected (%v, %q), got (%v, %q)", test.id, test.height, test.usable, test.reason, usable, reason)
+		}
+	}
+}
+
+// TestContractSetGC tests that GC removes only expired, fully-spent contracts
+// that are not currently acquired.
+func TestContractSetGC(t *testing.T) {
+	newContract := func(id byte, windowEnd types.BlockHeight, funds uint64) modules.RenterContract {
+		c := modules.RenterContract{ID: types.FileContractID{id}}
+		c.LastRevision.NewWindowEnd = windowEnd
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(funds)},
+			{Value: types.ZeroCurrency},
+		}
+		return c
+	}
+	cs := NewContractSet([]modules.RenterContract{
+		newContract(1, 200, 10), // live
+		newContract(2, 200, 0),  // spent, but not expired
+		newContract(3, 100, 10), // expired, but has funds
+		newContract(4, 100, 0),  // dead
+		newContract(5, 50, 0),   // dead
+		newContract(6, 100, 0),  // dead, but acquired
+	})
+	held, ok := cs.Acquire(types.FileContractID{6})
+	if !ok {
+		t.Fatal("failed to acquire contract")
+	}
+
+	// run GC concurrently with other users of the set
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c, ok := cs.Acquire(types.FileContractID{1})
+			if !ok {
+				t.Error("failed to acquire live contract")
+				return
+			}
+			cs.Return(c)
+		}
+	}()
+	collected := cs.GC(100)
+	<-done
+	exp := []types.FileContractID{{4}, {5}}
+	if !reflect.DeepEqual(collected, exp) {
+		t.Fatal("expected", exp, "got", collected)
+	}
+	for _, id := range []types.FileContractID{{1}, {2}, {3}, {6}} {
+		if !cs.Has(id) {
+			t.Error("GC removed contract", id)
+		}
+	}
+
+	// once returned, the held contract should be collected
+	cs.Return(held)
+	if collected := cs.GC(100); !reflect.DeepEqual(collected, []types.FileContractID{{6}}) {
+		t.Fatal("expected held contract to be collected, got", collected)
+	} else if cs.Len() != 3 {
+		t.Fatal("expected 3 contracts to remain, got", cs.Len())
+	}
+}
+
+// TestContractSetDiff tests that Diff reports added, removed, and modified
+// contracts, and that snapshots are unaffected by changes to the set.
+func TestContractSetDiff(t *testing.T) {
+	newContract := func(id byte, funds uint64) modules.RenterContract {
+		c := modules.RenterContract{ID: types.FileContractID{id}}
+		c.LastRevision.NewRevisionNumber = 1
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(funds)},
+			{Value: types.ZeroCurrency},
+		}
+		c.MerkleRoots = []crypto.Hash{{id}}
+		return c
+	}
+	cs := NewContractSet([]modules.RenterContract{
+		newContract(1, 100), // unchanged
+		newContract(2, 100), // modified
+		newContract(3, 100), // removed
+	})
+	before := cs.Snapshot()
+
+	c, _ := cs.Acquire(types.FileContractID{2})
+	c.LastRevision.NewRevisionNumber++
+	c.LastRevision.NewValidProofOutputs[0].Value = types.NewCurrency64(60)
+	c.MerkleRoots[0] = crypto.Hash{}
+	cs.Return(c)
+	c, _ = cs.Acquire(types.FileContractID{3})
+	cs.Delete(c)
+	cs.Insert(newContract(4, 100))
+	after := cs.Snapshot()
+
+	// the earlier snapshot must not have changed
+	if before.contracts[types.FileContractID{2}].MerkleRoots[0] != (crypto.Hash{2}) {
+		t.Fatal("snapshot was modified by a change to the set")
+	}
+
+	d := Diff(before, after)
+	if !reflect.DeepEqual(d.Added, []types.FileContractID{{4}}) {
+		t.Error("wrong added contracts:", d.Added)
+	}
+	if !reflect.DeepEqual(d.Removed, []types.FileContractID{{3}}) {
+		t.Error("wrong removed contracts:", d.Removed)
+	}
+	expMod := []ContractDiff{{
+		ID:                types.FileContractID{2},
+		OldRevisionNumber: 1,
+		NewRevisionNumber: 2,
+		OldRenterFunds:    types.NewCurrency64(100),
+		NewRenterFunds:    types.NewCurrency64(60),
+	}}
+	if !reflect.DeepEqual(d.Modified, expMod) {
+		t.Error("wrong modified contracts:", d.Modified)
+	}
+
+	// diffing a snapshot with itself should report no changes
+	if d := Diff(after, after); d.Added != nil || d.Removed != nil || d.Modified != nil {
+		t.Error("expected empty diff, got", d)
+	}
+}
+
+// TestContractSetHosts tests the Hosts and HasHost methods.
+func TestContractSetHosts(t *testing.T) {
+	var keys []types.SiaPublicKey
+	for i := 0; i < 3; i++ {
+		_, pk := crypto.GenerateKeyPair()
+		keys = append(keys, types.Ed25519PublicKey(pk))
+	}
+	// two contracts with keys[0], one with keys[1], none with keys[2]
+	cs := NewContractSet([]modules.RenterContract{
+		{ID: types.FileContractID{1}, HostPublicKey: keys[0]},
+		{ID: types.FileContractID{2}, HostPublicKey: keys[1]},
+		{ID: types.FileContractID{3}, HostPublicKey: keys[0]},
+	})
+
+	hosts := cs.Hosts()
+	if len(hosts) != 2 {
+		t.Fatal("expected 2 hosts, got", len(hosts))
+	}
+	found := make(map[string]bool)
+	for _, h := range hosts {
+		found[h.String()] = true
+	}
+	if !found[keys[0].String()] || !found[keys[1].String()] {
+		t.Fatal("Hosts is missing a host:", hosts)
+	}
+
+	if !cs.HasHost(keys[0]) || !cs.HasHost(keys[1]) {
+		t.Error("HasHost should report hosts with contracts")
+	}
+	if cs.HasHost(keys[2]) {
+		t.Error("HasHost should not report a host without contracts")
+	}
+}
+
+// TestContractSetLongHeldLocks tests that LongHeldLocks reports contracts
+// that were acquired but never returned.
+func TestContractSetLongHeldLocks(t *testing.T) {
+	if !build.DEBUG {
+		t.Skip("acquisitions are only tracked in debug builds")
+	}
+	cs := NewContractSet([]modules.RenterContract{
+		{ID: types.FileContractID{1}},
+		{ID: types.FileContractID{2}},
+	})
+	cs.mustAcquire(t, types.FileContractID{1}) // leaked
+	cs.Return(cs.mustAcquire(t, types.FileContractID{2}))
+
+	infos := cs.LongHeldLocks(0)
+	if len(infos) != 1 || infos[0].ID != (types.FileContractID{1}) {
+		t.Fatal("expected leaked contract to be reported, got", infos)
+	} else if !strings.Contains(infos[0].Stack, "TestContractSetLongHeldLocks") {
+		t.Fatal("stack does not identify the acquirer:", infos[0].Stack)
+	}
+	if infos := cs.LongHeldLocks(time.Hour); len(infos) != 0 {
+		t.Fatal("expected no contracts held for over an hour, got", infos)
+	}
+}
+
+// TestContractSetQueueDepth tests that QueueDepth reports the number of
+// callers waiting for a contract.
+func TestContractSetQueueDepth(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	if n := cs.QueueDepth(id); n != 0 {
+		t.Fatal("expected no waiters, got", n)
+	}
+	c := cs.mustAcquire(t, id)
+	if n := cs.QueueDepth(id); n != 0 {
+		t.Fatal("the holder should not be counted as a waiter, got", n)
+	}
+
+	const numWaiters = 5
+	var wg sync.WaitGroup
+	for i := 0; i < numWaiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cs.Return(cs.mustAcquire(t, id))
+		}()
+	}
+	for cs.QueueDepth(id) != numWaiters {
+		time.Sleep(time.Millisecond)
+	}
+
+	cs.Return(c)
+	wg.Wait()
+	if n := cs.QueueDepth(id); n != 0 {
+		t.Fatal("expected no waiters after all returned, got", n)
+	}
+	if n := cs.QueueDepth(types.FileContractID{2}); n != 0 {
+		t.Fatal("expected 0 for a missing contract, got", n)
+	}
+}
+
+// TestContractSetAcquireRead tests that readers share a contract, exclude
+// writers, and do not starve them.
+func TestContractSetAcquireRead(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	sc := cs.contracts[id]
+	waitQueued := func(n int) {
+		for cs.QueueDepth(id) != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// two readers can hold the contract at once
+	if _, ok := cs.AcquireRead(id); !ok {
+		t.Fatal("failed to acquire contract for reading")
+	}
+	if _, ok := cs.AcquireRead(id); !ok {
+		t.Fatal("failed to acquire contract for reading")
+	}
+
+	// a writer must wait for both readers, and a reader arriving after the
+	// writer must wait for it
+	var order []string
+	var orderMu sync.Mutex
+	record := func(s string) {
+		orderMu.Lock()
+		order = append(order, s)
+		orderMu.Unlock()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c := cs.mustAcquire(t, id)
+		record("writer")
+		cs.Return(c)
+	}()
+	waitQueued(1)
+	go func() {
+		defer wg.Done()
+		if _, ok := cs.AcquireRead(id); !ok {
+			t.Error("failed to acquire contract for reading")
+			return
+		}
+		record("reader")
+		cs.ReturnRead(id)
+	}()
+	waitQueued(2)
+	cs.ReturnRead(id)
+	cs.ReturnRead(id)
+	wg.Wait()
+	if !reflect.DeepEqual(order, []string{"writer", "reader"}) {
+		t.Fatal("wrong acquisition order:", order)
+	}
+
+	// if a waiting writer gives up, readers queued behind it should share
+	// the lock with the current reader
+	if _, ok := cs.AcquireRead(id); !ok {
+		t.Fatal("failed to acquire contract for reading")
+	}
+	cancel := make(chan struct{})
+	go cs.AcquireCancel(id, cancel)
+	waitQueued(1)
+	acquired := make(chan struct{})
+	go func() {
+		if _, ok := cs.AcquireRead(id); ok {
+			close(acquired)
+		}
+	}()
+	waitQueued(2)
+	close(cancel)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader was not woken after the writer ahead of it gave up")
+	}
+	cs.ReturnRead(id)
+	cs.ReturnRead(id)
+
+	// many readers and one writer, for the race detector
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%10 == 0 {
+				c := cs.mustAcquire(t, id)
+				c.MerkleRoots = append(c.MerkleRoots, crypto.Hash{byte(i)})
+				cs.Return(c)
+				return
+			}
+			c, ok := cs.AcquireRead(id)
+			if !ok {
+				t.Error("failed to acquire contract for reading")
+				return
+			}
+			_ = len(c.MerkleRoots)
+			cs.ReturnRead(id)
+		}(i)
+	}
+	wg.Wait()
+	if n, _ := cs.RootCount(id); n != 2 {
+		t.Fatal("expected 2 roots, got", n)
+	}
+	sc.mu.mu.Lock()
+	defer sc.mu.mu.Unlock()
+	if sc.mu.locked || sc.mu.readers != 0 {
+		t.Fatal("contract should be unlocked")
+	}
+}
+
+// TestContractSetFingerprint tests that fingerprints are equal for identical
+// contracts and change if a single root changes.
+func TestContractSetFingerprint(t *testing.T) {
+	newContract := func(id byte) modules.RenterContract {
+		c := modules.RenterContract{ID: types.FileContractID{id}}
+		c.LastRevision.NewRevisionNumber = 7
+		c.MerkleRoots = []crypto.Hash{{1}, {2}, {3}}
+		return c
+	}
+	a := NewContractSet([]modules.RenterContract{newContract(1), newContract(2)})
+	b := a.Clone()
+	if !reflect.DeepEqual(a.FingerprintAll(), b.FingerprintAll()) {
+		t.Fatal("identical sets should have identical fingerprints")
+	}
+	fp1, ok1 := a.Fingerprint(types.FileContractID{1})
+	fp2, ok2 := a.Fingerprint(types.FileContractID{2})
+	if !ok1 || !ok2 {
+		t.Fatal("missing fingerprint")
+	} else if fp1 == fp2 {
+		t.Fatal("different contracts should have different fingerprints")
+	} else if _, ok := a.Fingerprint(types.FileContractID{3}); ok {
+		t.Fatal("expected no fingerprint for a missing contract")
+	}
+
+	// changing a single root should change the fingerprint
+	c := b.mustAcquire(t, types.FileContractID{1})
+	c.MerkleRoots = append([]crypto.Hash(nil), c.MerkleRoots...)
+	c.MerkleRoots[1] = crypto.Hash{4}
+	b.Return(c)
+	if fp, _ := b.Fingerprint(types.FileContractID{1}); fp == fp1 {
+		t.Fatal("fingerprint did not change with a root")
+	}
+	if fp, _ := b.Fingerprint(types.FileContractID{2}); fp != fp2 {
+		t.Fatal("fingerprint of an unchanged contract changed")
+	}
+}
+
+// TestContractSetAcquireCtx tests that AcquireCtx respects cancellation and
+// records the context's trace ID.
+func TestContractSetAcquireCtx(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+
+	ctx := WithTraceID(context.Background(), "request-1")
+	c, ok := cs.AcquireCtx(ctx, id)
+	if !ok {
+		t.Fatal("failed to acquire contract")
+	}
+	if build.DEBUG {
+		infos := cs.LongHeldLocks(0)
+		if len(infos) != 1 || infos[0].TraceID != "request-1" {
+			t.Fatal("expected trace ID to be recorded, got", infos)
+		}
+	}
+
+	// a cancelled context should stop waiting for a held contract
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := cs.AcquireCtx(cancelled, id); ok {
+		t.Fatal("AcquireCtx acquired a held contract")
+	}
+	cs.Return(c)
+
+	// the trace ID should not outlive the acquisition
+	c, ok = cs.AcquireCtx(context.Background(), id)
+	if !ok {
+		t.Fatal("failed to acquire contract")
+	}
+	if build.DEBUG {
+		if infos := cs.LongHeldLocks(0); len(infos) != 1 || infos[0].TraceID != "" {
+			t.Fatal("expected no trace ID, got", infos)
+		}
+	}
+	cs.Return(c)
+}
+
+// TestContractSetAcquirePriority tests that higher-priority waiters are
+// granted a contract before lower-priority ones.
+func TestContractSetAcquirePriority(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	c := cs.mustAcquire(t, id)
+
+	// queue waiters one at a time, so that their arrival order is known
+	prios := []int{0, -1, 5, 0, 5, 10}
+	order := make(chan int, len(prios))
+	var wg sync.WaitGroup
+	for i, prio := range prios {
+		wg.Add(1)
+		go func(i, prio int) {
+			defer wg.Done()
+			c, ok := cs.AcquirePriority(id, prio)
+			if !ok {
+				t.Error("failed to acquire contract")
+				return
+			}
+			order <- i
+			cs.Return(c)
+		}(i, prio)
+		for cs.QueueDepth(id) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cs.Return(c)
+	wg.Wait()
+	close(order)
+
+	// highest priority first; equal priorities in arrival order
+	var got []int
+	for i := range order {
+		got = append(got, i)
+	}
+	if exp := []int{5, 2, 4, 0, 3, 1}; !reflect.DeepEqual(got, exp) {
+		t.Fatal("expected acquisition order", exp, "got", got)
+	}
+}
+
+// TestContractSetRebalanceCandidates tests that RebalanceCandidates
+// partitions contracts by their remaining funds.
+func TestContractSetRebalanceCandidates(t *testing.T) {
+	var contracts []modules.RenterContract
+	for i, funds := range []uint64{0, 50, 99, 100, 150, 199, 200, 1000} {
+		c := modules.RenterContract{ID: types.FileContractID{byte(i)}}
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(funds)},
+			{Value: types.ZeroCurrency},
+		}
+		contracts = append(contracts, c)
+	}
+	cs := NewContractSet(contracts)
+	low, high := cs.RebalanceCandidates(types.NewCurrency64(100))
+	expLow := []types.FileContractID{{0}, {1}, {2}}
+	expHigh := []types.FileContractID{{6}, {7}}
+	if !reflect.DeepEqual(low, expLow) {
+		t.Error("expected low", expLow, "got", low)
+	}
+	if !reflect.DeepEqual(high, expHigh) {
+		t.Error("expected high", expHigh, "got", high)
+	}
+}
+
+// TestContractSetStats tests the Stats method.
+func TestContractSetStats(t *testing.T) {
+	hostA := types.SiaPublicKey{Algorithm: types.SignatureEd25519, Key: []byte{1}}
+	hostB := types.SiaPublicKey{Algorithm: types.SignatureEd25519, Key: []byte{2}}
+	var contracts []modules.RenterContract
+	for i, host := range []types.SiaPublicKey{hostA, hostB, hostA} {
+		c := modules.RenterContract{
+			ID:               types.FileContractID{byte(i)},
+			HostPublicKey:    host,
+			MerkleRoots:      make(modules.MerkleRootSet, i+1),
+			DownloadSpending: types.NewCurrency64(1),
+			UploadSpending:   types.NewCurrency64(2),
+		}
+		c.LastRevision.NewWindowEnd = types.BlockHeight(100 * (3 - i))
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(10)},
+			{Value: types.ZeroCurrency},
+		}
+		contracts = append(contracts, c)
+	}
+	cs := NewContractSet(contracts)
+	exp := SetStats{
+		Contracts:         3,
+		TotalFunds:        types.NewCurrency64(39),
+		UsedFunds:         types.NewCurrency64(9),
+		Sectors:           6,
+		EarliestWindowEnd: 100,
+		LatestWindowEnd:   300,
+		HostContracts:     map[string]int{hostA.String(): 2, hostB.String(): 1},
+	}
+	if stats := cs.Stats(); !reflect.DeepEqual(stats, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, stats)
+	}
+
+	empty := NewContractSet(nil)
+	if stats := empty.Stats(); stats.Contracts != 0 || !stats.TotalFunds.IsZero() || stats.EarliestWindowEnd != 0 || len(stats.HostContracts) != 0 {
+		t.Fatalf("unexpected stats for empty set: %+v", stats)
+	}
+}
+
+// TestContractSetUtilization tests the Utilization method.
+func TestContractSetUtilization(t *testing.T) {
+	tests := []struct {
+		sectors   int
+		spent     uint64
+		remaining uint64
+		fraction  float64
+	}{
+		{0, 0, 1000, 0},
+		{5, 500, 500, 0.5},
+		{100, 999, 1, 0.999},
+	}
+	var contracts []modules.RenterContract
+	for i, test := range tests {
+		c := modules.RenterContract{
+			ID:             types.FileContractID{byte(i)},
+			MerkleRoots:    make(modules.MerkleRootSet, test.sectors),
+			UploadSpending: types.NewCurrency64(test.spent),
+		}
+		c.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{
+			{Value: types.NewCurrency64(test.remaining)},
+			{Value: types.ZeroCurrency},
+		}
+		contracts = append(contracts, c)
+	}
+	cs := NewContractSet(contracts)
+	for i, test := range tests {
+		sectors, fraction, ok := cs.Utilization(types.FileContractID{byte(i)})
+		if !ok {
+			t.Fatal("contract not found")
+		} else if sectors != uint64(test.sectors) {
+			t.Errorf("expected %v sectors, got %v", test.sectors, sectors)
+		} else if fraction != test.fraction {
+			t.Errorf("expected %v of funds used, got %v", test.fraction, fraction)
+		}
+	}
+	if _, _, ok := cs.Utilization(types.FileContractID{byte(len(tests))}); ok {
+		t.Error("Utilization should fail for a missing contract")
+	}
+}
+
+// TestContractSetAcquireMany tests that concurrent calls to AcquireMany with
+// overlapping sets of contracts do not deadlock.
+func TestContractSetAcquireMany(t *testing.T) {
+	id1, id2, id3 := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}
+	cs := NewContractSet([]modules.RenterContract{{ID: id1}, {ID: id2}, {ID: id3}})
+
+	// acquire overlapping sets in opposite orders
+	var wg sync.WaitGroup
+	for _, ids := range [][]types.FileContractID{{id1, id2, id3}, {id3, id2, id1}, {id2, id1, id2}} {
+		wg.Add(1)
+		go func(ids []types.FileContractID) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				contracts, ok := cs.AcquireMany(ids)
+				if !ok {
+					t.Error("AcquireMany failed")
+					return
+				}
+				for j := range contracts {
+					contracts[j].LastRevision.NewRevisionNumber++
+				}
+				cs.ReturnMany(contracts)
+			}
+		}(ids)
+	}
+	wg.Wait()
+	c2 := cs.mustAcquire(t, id2)
+	cs.Return(c2)
+	if c2.LastRevision.NewRevisionNumber != 300 {
+		t.Fatal("expected 300 increments, got", c2.LastRevision.NewRevisionNumber)
+	}
+
+	// a missing contract should cause all acquired contracts to be returned
+	if _, ok := cs.AcquireMany([]types.FileContractID{id1, {4}, id3}); ok {
+		t.Fatal("AcquireMany should fail when a contract is missing")
+	}
+	contracts, ok := cs.AcquireMany([]types.FileContractID{id3, id1})
+	if !ok || len(contracts) != 2 || contracts[0].ID != id1 || contracts[1].ID != id3 {
+		t.Fatal("AcquireMany returned wrong contracts:", contracts)
+	}
+	cs.ReturnMany(contracts)
+}
+
+// TestContractSetAcquireVerified tests that AcquireVerified detects contracts
+// whose Merkle roots do not match their revision.
+func TestContractSetAcquireVerified(t *testing.T) {
+	good := modules.RenterContract{
+		ID:          types.FileContractID{1},
+		MerkleRoots: modules.MerkleRootSet{{1}, {2}, {3}},
+	}
+	good.LastRevision.NewFileMerkleRoot = cachedMerkleRoot(good.MerkleRoots)
+	bad := good
+	bad.ID = types.FileContractID{2}
+	bad.MerkleRoots = modules.MerkleRootSet{{1}, {2}, {4}}
+	empty := modules.RenterContract{ID: types.FileContractID{3}}
+	cs := NewContractSet([]modules.RenterContract{good, bad, empty})
+
+	for _, id := range []types.FileContractID{good.ID, empty.ID} {
+		c, err := cs.AcquireVerified(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.Return(c)
+	}
+	if _, err := cs.AcquireVerified(bad.ID); err != ErrMerkleRootMismatch {
+		t.Fatal("expected ErrMerkleRootMismatch, got", err)
+	}
+	if _, err := cs.AcquireVerified(types.FileContractID{4}); err != ErrContractNotFound {
+		t.Fatal("expected ErrContractNotFound, got", err)
+	}
+	// the corrupt contract should have been returned to the set
+	cs.Return(cs.mustAcquire(t, bad.ID))
+}
+
+// TestContractSetAcquireCancel tests that AcquireCancel stops waiting for a
+// locked contract when cancel is closed.
+func TestContractSetAcquireCancel(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	c := cs.mustAcquire(t, id)
+
+	cancel := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		_, ok := cs.AcquireCancel(id, cancel)
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(cancel)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("AcquireCancel acquired a locked contract")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AcquireCancel did not return after cancel was closed")
+	}
+
+	// the original holder should still be able to return the contract
+	cs.Return(c)
+	if _, ok := cs.AcquireCancel(id, make(chan struct{})); !ok {
+		t.Fatal("AcquireCancel failed to acquire an unlocked contract")
+	}
+}
+
+// TestContractSetAcquireFIFO tests that waiters acquire a contract in the
+// order that they called Acquire, so that no waiter is starved.
+func TestContractSetAcquireFIFO(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	sc := cs.contracts[id]
+	c := cs.mustAcquire(t, id)
+
+	// queue up waiters one at a time, so that their arrival order is known
+	const numWaiters = 50
+	order := make(chan int, numWaiters)
+	var wg sync.WaitGroup
+	for i := 0; i < numWaiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := cs.mustAcquire(t, id)
+			order <- i
+			cs.Return(c)
+		}(i)
+		for queued := 0; queued != i+1; {
+			time.Sleep(time.Millisecond)
+			sc.mu.mu.Lock()
+			queued = len(sc.mu.waiters)
+			sc.mu.mu.Unlock()
+		}
+	}
+	// a waiter that gives up should not disturb the queue
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, ok := cs.AcquireCancel(id, cancel); ok {
+		t.Fatal("AcquireCancel acquired a locked contract")
+	}
+
+	cs.Return(c)
+	wg.Wait()
+	close(order)
+	next := 0
+	for i := range order {
+		if i != next {
+			t.Fatalf("waiter %v acquired the contract before waiter %v", i, next)
+		}
+		next++
+	}
+}
+
+// TestContractSetSubscribe tests that subscribers are notified of changes to
+// the set, and that a slow subscriber does not block the set.
+func TestContractSetSubscribe(t *testing.T) {
+	cs := NewContractSet(nil)
+	fast, unsubFast := cs.Subscribe()
+	slow, unsubSlow := cs.Subscribe()
+	defer unsubSlow()
+
+	c := modules.RenterContract{ID: types.FileContractID{1}, MerkleRoots: modules.MerkleRootSet{{1}}}
+	cs.Insert(c)
+	if update := <-fast; update.ID != c.ID || update.MerkleRoots != nil {
+		t.Fatal("unexpected update:", update)
+	}
+	for i := 0; i < subscriberBuffer*2; i++ {
+		c = cs.mustAcquire(t, c.ID)
+		c.LastRevision.NewRevisionNumber++
+		cs.Return(c)
+		if update := <-fast; update.LastRevision.NewRevisionNumber != c.LastRevision.NewRevisionNumber {
+			t.Fatal("unexpected update:", update)
+		}
+	}
+	// the slow subscriber should have received only what fit in its buffer
+	if len(slow) != subscriberBuffer {
+		t.Fatalf("expected %v buffered updates, got %v", subscriberBuffer, len(slow))
+	}
+
+	// unsubscribing should close the channel, and may be repeated
+	unsubFast()
+	unsubFast()
+	if _, ok := <-fast; ok {
+		t.Fatal("expected channel to be closed")
+	}
+}
+
+// TestContractSetReturnErr tests that ReturnErr reports missing contracts
+// instead of panicking.
+func TestContractSetReturnErr(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	c := cs.mustAcquire(t, id)
+	if err := cs.ReturnErr(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.ReturnErr(modules.RenterContract{ID: types.FileContractID{2}}); err != ErrContractNotFound {
+		t.Fatal("expected ErrContractNotFound, got", err)
+	}
+}
+
+// BenchmarkContractSetAcquire benchmarks acquiring a contract with Acquire
+// and AcquireUnsafe. The contract's lock is released directly rather than via
+// Return, so that only the acquisition is measured. On a single-core Xeon VM:
+//
+//	BenchmarkContractSetAcquire/Acquire         127 ns/op
+//	BenchmarkContractSetAcquire/AcquireUnsafe    71 ns/op
+func BenchmarkContractSetAcquire(b *testing.B) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	sc := cs.contracts[id]
+	b.Run("Acquire", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cs.Acquire(id)
+			sc.mu.unlock()
+		}
+	})
+	b.Run("AcquireUnsafe", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cs.AcquireUnsafe(id)
+			sc.mu.unlock()
+		}
+	})
+}
+
+// TestContractSetSweep tests that Sweep visits each contract in order of ID,
+// keeps the changes made to them, and combines the errors returned.
+func TestContractSetSweep(t *testing.T) {
+	id1, id2, id3 := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}
+	cs := NewContractSet([]modules.RenterContract{{ID: id3}, {ID: id1}, {ID: id2}})
+
+	var visited []types.FileContractID
+	err := cs.Sweep(func(c *modules.RenterContract) error {
+		visited = append(visited, c.ID)
+		c.LastRevision.NewRevisionNumber++
+		if c.ID == id2 {
+			return errors.New("bad contract")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "bad contract" {
+		t.Fatal("expected fn error, got", err)
+	} else if !reflect.DeepEqual(visited, []types.FileContractID{id1, id2, id3}) {
+		t.Fatal("contracts visited in wrong order:", visited)
+	}
+	for _, id := range visited {
+		c := cs.mustAcquire(t, id)
+		cs.Return(c)
+		if c.LastRevision.NewRevisionNumber != 1 {
+			t.Fatal("contract was not modified:", id)
+		}
+	}
+}
+
+// TestContractSetAcquireTimeout tests that Acquire gives up on a held
+// contract after the set's AcquireTimeout, while AcquireCtx is unaffected.
+func TestContractSetAcquireTimeout(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	cs.AcquireTimeout = 10 * time.Millisecond
+	c := cs.mustAcquire(t, id)
+
+	start := time.Now()
+	if _, ok := cs.Acquire(id); ok {
+		t.Fatal("acquired a held contract")
+	} else if elapsed := time.Since(start); elapsed < cs.AcquireTimeout {
+		t.Fatal("Acquire gave up early:", elapsed)
+	}
+	if _, err := cs.AcquireVerified(id); err != ErrAcquireTimeout {
+		t.Fatal("expected ErrAcquireTimeout, got", err)
+	}
+
+	// AcquireCtx waits for as long as its context allows
+	go func() {
+		time.Sleep(5 * cs.AcquireTimeout)
+		cs.Return(c)
+	}()
+	if _, ok := cs.AcquireCtx(context.Background(), id); !ok {
+		t.Fatal("AcquireCtx failed")
+	}
+}
+
+// TestContractSetWithContract tests that WithContract keeps the changes made
+// by fn, and returns the contract even if fn panics.
+func TestContractSetWithContract(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+
+	err := cs.WithContract(id, func(c *modules.RenterContract) error {
+		c.LastRevision.NewRevisionNumber++
+		return errors.New("fn failed")
+	})
+	if err == nil || err.Error() != "fn failed" {
+		t.Fatal("expected fn error, got", err)
+	}
+	if err := cs.WithContract(types.FileContractID{2}, nil); err != ErrContractNotFound {
+		t.Fatal("expected ErrContractNotFound, got", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		cs.WithContract(id, func(c *modules.RenterContract) error {
+			c.LastRevision.NewRevisionNumber++
+			panic("fn panicked")
+		})
+	}()
+
+	// the contract should have been returned, with both changes
+	c := cs.mustAcquire(t, id)
+	cs.Return(c)
+	if c.LastRevision.NewRevisionNumber != 2 {
+		t.Fatal("expected 2 revisions, got", c.LastRevision.NewRevisionNumber)
+	}
+}
+
+// TestContractSetAcquireDeleted tests that goroutines waiting to acquire a
+// contract give up when it is deleted, rather than acquiring a contract that
+// is no longer in the set.
+func TestContractSetAcquireDeleted(t *testing.T) {
+	id := types.FileContractID{1}
+	cs := NewContractSet([]modules.RenterContract{{ID: id}})
+	c := cs.mustAcquire(t, id)
+
+	results := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			var ok bool
+			switch i {
+			case 0:
+				_, ok = cs.Acquire(id)
+			case 1:
+				_, ok = cs.AcquirePriority(id, 1)
+			case 2:
+				_, ok = cs.AcquireRead(id)
+			}
+			results <- ok
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cs.Delete(c)
+	for i := 0; i < 3; i++ {
+		select {
+		case ok := <-results:
+			if ok {
+				t.Fatal("acquired a deleted contract")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not released by Delete")
+		}
+	}
+
+	// interleave Acquire and Delete on the same ID; every contract that is
+	// acquired must still be in the set when it is returned
+	cs.Insert(modules.RenterContract{ID: id})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if c, ok := cs.Acquire(id); ok {
+					if err := cs.ReturnErr(c); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		cs.Delete(cs.mustAcquire(t, id))
+		cs.Insert(modules.RenterContract{ID: id})
+	}
+	wg.Wait()
+}
+
+// TestContractSetLeakDetection tests that, in debug builds, a contract that
+// is garbage collected while acquired is reported as leaked.
+func TestContractSetLeakDetection(t *testing.T) {
+	if !build.DEBUG {
+		t.Skip("leak detection is only enabled in debug builds")
+	}
+	leaked := make(chan types.FileContractID, 10)
+	leakHookMu.Lock()
+	leakHook = func(id types.FileContractID, _ []byte) {
+		select {
+		case leaked <- id:
+		default:
+		}
+	}
+	leakHookMu.Unlock()
+	defer func() {
+		leakHookMu.Lock()
+		leakHook = nil
+		leakHookMu.Unlock()
+	}()
+
+	// acquire a contract and discard the set without returning it
+	id := types.FileContractID{0xde, 0xad}
+	func() {
+		cs := NewContractSet([]modules.RenterContract{{ID: id}})
+		cs.mustAcquire(t, id)
+	}()
+
+	timeout := time.After(time.Second)
+	for {
+		runtime.GC()
+		select {
+		case leakedID := <-leaked:
+			if leakedID == id {
+				return
+			}
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("leaked contract was not reported")
+		}
+	}
+}
+
+// TestContractSetWriteMetrics tests that WriteMetrics produces valid
+// Prometheus text exposition format with the expected values.
+func TestContractSetWriteMetrics(t *testing.T) {
+	c1 := modules.RenterContract{ID: types.FileContractID{1}}
+	c1.LastRevision.NewValidProofOutputs = []types.SiacoinOutput{{Value: types.NewCurrency64(10)}, {}}
+	c2 := c1
+	c2.ID = types.FileContractID{2}
+	cs := NewContractSet([]modules.RenterContract{c1, c2})
+	c := cs.mustAcquire(t, c1.ID)
+	c.MerkleRoots = append(c.MerkleRoots, crypto.Hash{1}, crypto.Hash{2})
+	c.UploadSpending = types.NewCurrency64(5)
+	cs.Return(c)
+
+	var buf bytes.Buffer
+	if err := cs.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	metricTypes := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		} else if strings.HasPrefix(line, "# TYPE ") {
+			if len(fields) != 4 || (fields[3] != "gauge" && fields[3] != "counter") {
+				t.Fatal("invalid TYPE line:", line)
+			}
+			metricTypes[fields[2]] = fields[3]
+			continue
+		}
+		if len(fields) != 2 {
+			t.Fatal("invalid sample line:", line)
+		} else if _, ok := metricTypes[fields[0]]; !ok {
+			t.Fatal("sample has no preceding TYPE line:", line)
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatal("invalid sample value:", line)
+		}
+		values[fields[0]] = v
+	}
+
+	exp := map[string]float64{
+		"sia_contractset_contracts":            2,
+		"sia_contractset_total_funds_hastings": 25,
+		"sia_contractset_used_funds_hastings":  5,
+		"sia_contractset_sectors":              2,
+		"sia_contractset_acquires_total":       1,
+	}
+	if !reflect.DeepEqual(values, exp) {
+		t.Fatal("wrong metrics:", values)
+	}
+}
@@ -1,7 +1,10 @@
 package proto
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -28,13 +31,29 @@ type Downloader struct {
 // Sector retrieves the sector with the specified Merkle root, and revises
 // the underlying contract to pay the host proportionally to the data
 // retrieve.
-func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []byte, err error) {
+func (hd *Downloader) Sector(root crypto.Hash) (modules.RenterContract, []byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(modules.SectorSize))
+	contract, err := hd.SectorTo(root, &buf)
+	if err != nil {
+		return modules.RenterContract{}, nil, err
+	}
+	return contract, buf.Bytes(), nil
+}
+
+// SectorTo is like Sector, but streams the sector data to w as it arrives
+// instead of buffering it. The data is verified against root only after it
+// has all been written, so if SectorTo returns an error, the bytes written to
+// w must not be trusted. If w returns an error, the rest of the sector is
+// still read and the contract is still revised, and the revised contract is
+// returned along with the error.
+func (hd *Downloader) SectorTo(root crypto.Hash, w io.Writer) (_ modules.RenterContract, err error) {
 	defer extendDeadline(hd.conn, time.Hour) // reset deadline when finished
 
 	// calculate price
 	sectorPrice := hd.host.DownloadBandwidthPrice.Mul64(modules.SectorSize)
 	if hd.contract.RenterFunds().Cmp(sectorPrice) < 0 {
-		return modules.RenterContract{}, nil, errors.New("contract has insufficient funds to support download")
+		return modules.RenterContract{}, errors.New("contract has insufficient funds to support download")
 	}
 	// to mitigate small errors (e.g. differing block heights), fudge the
 	// price and collateral by 0.2%. This is only applied to hosts above
@@ -49,7 +68,7 @@ func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []by
 	// initiate download by confirming host settings
 	extendDeadline(hd.conn, modules.NegotiateSettingsTime)
 	if err := startDownload(hd.conn, hd.host); err != nil {
-		return modules.RenterContract{}, nil, err
+		return modules.RenterContract{}, err
 	}
 
 	// Before we continue, save the revision. Unexpected termination (e.g.
@@ -59,7 +78,7 @@ func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []by
 	// we save the old revision as a fallback.
 	if hd.SaveFn != nil {
 		if err := hd.SaveFn(rev, hd.contract.MerkleRoots); err != nil {
-			return modules.RenterContract{}, nil, err
+			return modules.RenterContract{}, err
 		}
 	}
 
@@ -71,14 +90,16 @@ func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []by
 		Length:     modules.SectorSize,
 	}})
 	if err != nil {
-		return modules.RenterContract{}, nil, err
+		return modules.RenterContract{}, err
 	}
 
-	// Increase Successful/Failed interactions accordingly
+	// Increase Successful/Failed interactions accordingly. A failure of w is
+	// not the host's fault, so it is recorded as a success.
+	var writeErr error
 	defer func() {
-		if err != nil {
+		if err != nil && err != writeErr {
 			hd.hdb.IncrementFailedInteractions(hd.contract.HostPublicKey)
-		} else if err == nil {
+		} else {
 			hd.hdb.IncrementSuccessfulInteractions(hd.contract.HostPublicKey)
 		}
 	}()
@@ -92,22 +113,39 @@ func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []by
 		// until we've finished downloading the sector.
 		defer hd.conn.Close()
 	} else if err != nil {
-		return modules.RenterContract{}, nil, err
+		return modules.RenterContract{}, err
 	}
 
-	// read sector data, completing one iteration of the download loop
+	// read sector data, completing one iteration of the download loop. The
+	// data is an encoded [][]byte containing a single sector, preceded by
+	// its length.
 	extendDeadline(hd.conn, modules.NegotiateDownloadTime)
-	var sectors [][]byte
-	if err := encoding.ReadObject(hd.conn, &sectors, modules.SectorSize+16); err != nil {
-		return modules.RenterContract{}, nil, err
-	} else if len(sectors) != 1 {
-		return modules.RenterContract{}, nil, errors.New("host did not send enough sectors")
+	prefix := make([]byte, 24)
+	if _, err := io.ReadFull(hd.conn, prefix); err != nil {
+		return modules.RenterContract{}, err
+	} else if encoding.DecUint64(prefix[:8]) != modules.SectorSize+16 {
+		return modules.RenterContract{}, errors.New("host sent sector data of wrong size")
+	} else if encoding.DecUint64(prefix[8:16]) != 1 {
+		return modules.RenterContract{}, errors.New("host did not send enough sectors")
+	} else if encoding.DecUint64(prefix[16:]) != modules.SectorSize {
+		return modules.RenterContract{}, errors.New("host did not send enough sector data")
 	}
-	sector := sectors[0]
-	if uint64(len(sector)) != modules.SectorSize {
-		return modules.RenterContract{}, nil, errors.New("host did not send enough sector data")
-	} else if crypto.MerkleRoot(sector) != root {
-		return modules.RenterContract{}, nil, errors.New("host sent bad sector data")
+	// the reader is limited to the sector, so that buffering does not
+	// consume the start of the next iteration
+	r := bufio.NewReaderSize(io.LimitReader(hd.conn, int64(modules.SectorSize)), 1<<16)
+	tree := crypto.NewTree()
+	segment := make([]byte, crypto.SegmentSize)
+	for i := uint64(0); i < modules.SectorSize/crypto.SegmentSize; i++ {
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return modules.RenterContract{}, err
+		}
+		tree.Push(segment)
+		if writeErr == nil {
+			_, writeErr = w.Write(segment)
+		}
+	}
+	if tree.Root() != root {
+		return modules.RenterContract{}, errors.New("host sent bad sector data")
 	}
 
 	// update contract and metrics
@@ -115,7 +153,26 @@ func (hd *Downloader) Sector(root crypto.Hash) (_ modules.RenterContract, _ []by
 	hd.contract.LastRevisionTxn = signedTxn
 	hd.contract.DownloadSpending = hd.contract.DownloadSpending.Add(sectorPrice)
 
-	return hd.contract, sector, nil
+	// the host has been paid, so the revised contract is returned even if w
+	// failed
+	return hd.contract, writeErr
+}
+
+// DownloadFile downloads each sector in roots, in order, and writes it to w.
+// Each sector is verified against its root before any of it is written, so w
+// only ever receives verified data. If a sector cannot be downloaded or
+// verified, DownloadFile stops and returns an error naming its root.
+func DownloadFile(hd *Downloader, roots []crypto.Hash, w io.Writer) error {
+	for _, root := range roots {
+		_, data, err := hd.Sector(root)
+		if err != nil {
+			return errors.New("could not download sector " + root.String() + ": " + err.Error())
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // shutdown terminates the revision loop and signals the goroutine spawned in
@@ -159,10 +216,7 @@ func NewDownloader(host modules.HostDBEntry, contract modules.RenterContract, hd
 	}()
 
 	// initiate download loop
-	conn, err := (&net.Dialer{
-		Cancel:  cancel,
-		Timeout: 15 * time.Second,
-	}).Dial("tcp", string(contract.NetAddress))
+	conn, err := dialHost(contract.NetAddress, 15*time.Second, cancel)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,209 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// serveDownloads runs the host side of the download loop, sending the
+// requested sectors from h.sectors.
+func (h *testHost) serveDownloads(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := crypto.WriteSignedObject(conn, h.entry.HostExternalSettings, h.sk); err != nil {
+			return
+		}
+		if err := modules.ReadNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		var actions []modules.DownloadAction
+		var rev types.FileContractRevision
+		if err := encoding.ReadObject(conn, &actions, modules.NegotiateMaxDownloadActionRequestSize); err != nil {
+			return
+		}
+		if err := encoding.ReadObject(conn, &rev, modules.NegotiateMaxFileContractRevisionSize); err != nil {
+			return
+		}
+		if err := modules.WriteNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		var renterSig types.TransactionSignature
+		if err := encoding.ReadObject(conn, &renterSig, modules.NegotiateMaxTransactionSignatureSize); err != nil {
+			return
+		}
+		txn := types.Transaction{
+			FileContractRevisions: []types.FileContractRevision{rev},
+			TransactionSignatures: []types.TransactionSignature{renterSig, {
+				ParentID:       crypto.Hash(rev.ParentID),
+				CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+				PublicKeyIndex: 1,
+			}},
+		}
+		sig := crypto.SignHash(txn.SigHash(1), h.sk)
+		txn.TransactionSignatures[1].Signature = sig[:]
+		if err := modules.WriteNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		if err := encoding.WriteObject(conn, txn.TransactionSignatures[1]); err != nil {
+			return
+		}
+		var sectors [][]byte
+		for _, action := range actions {
+			sectors = append(sectors, h.Sector(action.MerkleRoot))
+		}
+		if err := encoding.WriteObject(conn, sectors); err != nil {
+			return
+		}
+	}
+}
+
+// newTestDownloader returns a Downloader connected to a testHost.
+func newTestDownloader(t testing.TB) (*Downloader, *testHost) {
+	renterSK, renterPK := crypto.GenerateKeyPair()
+	hostSK, hostPK := crypto.GenerateKeyPair()
+	host := &testHost{sk: hostSK, sectors: make(map[crypto.Hash][]byte)}
+	host.entry.PublicKey = types.Ed25519PublicKey(hostPK)
+	host.entry.NetAddress = "host.com:1234"
+	host.entry.Version = "1.3.0"
+	host.entry.DownloadBandwidthPrice = types.NewCurrency64(1)
+
+	rConn, hConn := net.Pipe()
+	go host.serveDownloads(hConn)
+	hd := &Downloader{
+		conn:      rConn,
+		closeChan: make(chan struct{}),
+		host:      host.entry,
+		hdb:       new(testHostDB),
+		contract:  newTestContract(renterSK, renterPK, hostPK),
+	}
+	return hd, host
+}
+
+// countingWriter is an io.Writer that counts the bytes written to it.
+type countingWriter struct {
+	n     int
+	limit int // if nonzero, writes fail after limit bytes
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.limit != 0 && w.n+len(p) > w.limit {
+		return 0, errors.New("limit reached")
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+// TestDownloaderSectorTo tests that SectorTo streams sector data to the
+// writer and verifies it against the requested root.
+func TestDownloaderSectorTo(t *testing.T) {
+	hd, host := newTestDownloader(t)
+	defer hd.Close()
+
+	sector := fastrand.Bytes(int(modules.SectorSize))
+	root := crypto.MerkleRoot(sector)
+	host.mu.Lock()
+	host.sectors[root] = sector
+	host.mu.Unlock()
+
+	var w countingWriter
+	contract, err := hd.SectorTo(root, &w)
+	if err != nil {
+		t.Fatal(err)
+	} else if uint64(w.n) != modules.SectorSize {
+		t.Fatalf("expected %v bytes to be written, got %v", modules.SectorSize, w.n)
+	} else if contract.LastRevision.NewRevisionNumber != 2 {
+		t.Fatal("contract was not revised:", contract.LastRevision.NewRevisionNumber)
+	}
+
+	// Sector should return the same data
+	_, data, err := hd.Sector(root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, sector) {
+		t.Fatal("Sector returned wrong data")
+	}
+
+	// a write error should still revise the contract, and should not be
+	// held against the host
+	hdb := hd.hdb.(*testHostDB)
+	w = countingWriter{limit: 1 << 10}
+	if contract, err := hd.SectorTo(root, &w); err == nil || err.Error() != "limit reached" {
+		t.Fatal("expected write error, got", err)
+	} else if hdb.failures != 0 || hdb.successes != 3 {
+		t.Fatal("write error should be recorded as a success:", hdb.failures, hdb.successes)
+	} else if hd.contract.LastRevision.NewRevisionNumber != 4 {
+		t.Fatal("contract was not revised after write error:", hd.contract.LastRevision.NewRevisionNumber)
+	} else if contract.LastRevision.NewRevisionNumber != 4 {
+		t.Fatal("revised contract was not returned after write error:", contract.LastRevision.NewRevisionNumber)
+	}
+
+	// if the host sends the wrong data, the whole sector is still streamed,
+	// but an error is returned
+	bad := append([]byte(nil), sector...)
+	bad[0]++
+	host.mu.Lock()
+	host.sectors[root] = bad
+	host.mu.Unlock()
+	w = countingWriter{}
+	if _, err := hd.SectorTo(root, &w); err == nil || !strings.Contains(err.Error(), "bad sector data") {
+		t.Fatal("expected bad sector data error, got", err)
+	} else if uint64(w.n) != modules.SectorSize {
+		t.Fatalf("expected %v bytes to be written, got %v", modules.SectorSize, w.n)
+	}
+}
+
+// TestDownloadFile tests that a file uploaded with UploadAll can be
+// downloaded and reassembled with DownloadFile.
+func TestDownloadFile(t *testing.T) {
+	he, uploadHost := newTestEditor(t)
+	defer he.Close()
+
+	sectors := make([][]byte, 3)
+	for i := range sectors {
+		sectors[i] = fastrand.Bytes(int(modules.SectorSize))
+	}
+	roots, err := UploadAll(he, sectors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serve the uploaded sectors from the download host
+	hd, host := newTestDownloader(t)
+	defer hd.Close()
+	host.mu.Lock()
+	for _, root := range roots {
+		host.sectors[root] = uploadHost.Sector(root)
+	}
+	host.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := DownloadFile(hd, roots, &buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), bytes.Join(sectors, nil)) {
+		t.Fatal("downloaded file does not match uploaded file")
+	}
+
+	// corrupt the second sector; the error should name its root, and only
+	// the first sector should be written
+	bad := append([]byte(nil), sectors[1]...)
+	bad[0]++
+	host.mu.Lock()
+	host.sectors[roots[1]] = bad
+	host.mu.Unlock()
+	buf.Reset()
+	if err := DownloadFile(hd, roots, &buf); err == nil || !strings.Contains(err.Error(), roots[1].String()) {
+		t.Fatal("expected error naming bad root, got", err)
+	} else if !bytes.Equal(buf.Bytes(), sectors[0]) {
+		t.Fatal("expected only the first sector to be written")
+	}
+}
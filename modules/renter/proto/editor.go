@@ -1,9 +1,15 @@
 package proto
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NebulousLabs/Sia/build"
@@ -13,24 +19,81 @@ import (
 	"github.com/NebulousLabs/Sia/types"
 )
 
+var (
+	// ErrHostBlacklisted is returned by NewEditor if the host is rejected by
+	// the Gate supplied in EditorOptions.
+	ErrHostBlacklisted = errors.New("host is blacklisted")
+
+	// ErrContractExpired is returned when uploading to a contract whose
+	// proof window has ended.
+	ErrContractExpired = errors.New("contract has expired")
+
+	// ErrHostStopped is returned by operations attempted after the host has
+	// terminated the revision loop. The revision during which the host
+	// terminated the loop is not affected; it was committed by the host.
+	ErrHostStopped = errors.New("host has terminated the revision loop")
+
+	// ErrUploadTimeout is returned by UploadTimeout if the upload does not
+	// complete in time.
+	ErrUploadTimeout = errors.New("upload timed out")
+
+	// errEditorAborted is returned when reconnecting an Editor after Abort
+	// has been called.
+	errEditorAborted = errors.New("editor was aborted")
+
+	// ErrInvalidHostAddress is returned by NewEditor if the contract's
+	// NetAddress is malformed, such as an empty address or one without a
+	// port.
+	ErrInvalidHostAddress = errors.New("host address is invalid")
+
+	// ErrRootMismatch is returned if the host's signature does not commit to
+	// the revision, and thus the Merkle root, computed by the renter.
+	ErrRootMismatch = errors.New("host did not sign the renter's Merkle root")
+)
+
 var hostPriceLeeway = build.Select(build.Var{
 	Dev:      0.05,
 	Standard: 0.002,
 	Testing:  0.002,
 }).(float64)
 
+// closeTimeout bounds the time spent gracefully terminating the revision
+// loop in Close, so that an unresponsive host cannot delay shutdown. If it
+// elapses, the connection is closed without the host's cooperation.
+var closeTimeout = 5 * time.Second
+
+// maxLatencySamples is the number of upload durations retained by an Editor
+// for computing latency percentiles.
+const maxLatencySamples = 1000
+
 var (
 	// sectorHeight is the height of a Merkle tree that covers a single
-	// sector. It is log2(modules.SectorSize / crypto.SegmentSize)
+	// sector. It is log2(modules.SectorSize / crypto.SegmentSize). The
+	// cached Merkle roots and proofs assume that each sector is a complete
+	// tree, so initialization panics if the sector size is not a power-of-two
+	// multiple of the segment size.
 	sectorHeight = func() uint64 {
+		if modules.SectorSize%crypto.SegmentSize != 0 {
+			panic("sector size is not a multiple of the segment size")
+		}
+		segments := modules.SectorSize / crypto.SegmentSize
 		height := uint64(0)
-		for 1<<height < (modules.SectorSize / crypto.SegmentSize) {
+		for 1<<height < segments {
 			height++
 		}
+		if 1<<height != segments {
+			panic("sector size is not a power-of-two multiple of the segment size")
+		}
 		return height
 	}()
 )
 
+// SectorTreeHeight returns the height of the Merkle tree formed by the
+// segments of a single sector.
+func SectorTreeHeight() uint64 {
+	return sectorHeight
+}
+
 // cachedMerkleRoot calculates the root of a set of existing Merkle roots.
 func cachedMerkleRoot(roots []crypto.Hash) crypto.Hash {
 	tree := crypto.NewCachedTree(sectorHeight) // NOTE: height is not strictly necessary here
@@ -40,58 +103,429 @@ func cachedMerkleRoot(roots []crypto.Hash) crypto.Hash {
 	return tree.Root()
 }
 
+// cachedMerkleProof calculates a proof that the Merkle root at index is a
+// member of the tree formed by roots. Combined with a segment proof within
+// the sector, it forms a storage proof against the tree's root.
+func cachedMerkleProof(roots []crypto.Hash, index uint64) []crypto.Hash {
+	tree := crypto.NewCachedTree(sectorHeight)
+	_ = tree.SetIndex(index << sectorHeight) // tree is empty, so SetIndex cannot fail
+	for _, h := range roots {
+		tree.Push(h)
+	}
+	return tree.Prove(roots[index][:], nil)
+}
+
 // A Editor modifies a Contract by calling the revise RPC on a host. It
 // Editors are NOT thread-safe; calls to Upload must happen in serial.
 type Editor struct {
 	conn      net.Conn
 	closeChan chan struct{}
 	once      sync.Once
+	connMu    sync.Mutex // guards conn, closeChan, and once against Abort
+	aborted   int32      // accessed atomically
+	stopped   bool       // host sent StopResponse
+	cancel    <-chan struct{}
 	host      modules.HostDBEntry
 	hdb       hostDB
+	log       logger
+
+	// pendingSettings is set if RefreshSettings has read the settings that
+	// begin the next revision iteration
+	pendingSettings bool
 
 	height   types.BlockHeight
 	contract modules.RenterContract // updated after each revision
 
+	sendRetries      int
+	sendRetryBackoff time.Duration
+
+	// uploadRate, if positive, limits writes to the host to this many bytes
+	// per second
+	uploadRate int64
+
+	// resolver, if set, translates the host's address before dialing
+	resolver func(modules.NetAddress) (string, error)
+
+	// wrapConn, if set, wraps each connection to the host after dialing
+	wrapConn func(net.Conn) (net.Conn, error)
+
+	latency latencySamples
+	rtt     time.Duration
+
+	// clock is the source of the current time for deadlines and latency
+	// measurements. If nil, the system clock is used.
+	clock clock
+
+	// queue holds uploads submitted by QueueUpload; draining is set while a
+	// goroutine is uploading them
+	queue    chan queuedUpload
+	draining bool
+	queueMu  sync.Mutex
+
 	SaveFn revisionSaver
+
+	// OnSendActions, OnSendRevision, and OnReceiveSignature are optional
+	// callbacks that trace the phases of each revision iteration. They are
+	// invoked after the revision actions are sent, after the revision and
+	// the renter's signature are sent, and after the host's signature is
+	// received, respectively, and are passed the time spent in that phase.
+	OnSendActions      func(time.Duration)
+	OnSendRevision     func(time.Duration)
+	OnReceiveSignature func(time.Duration)
+
+	// OnProgress, if set, is called repeatedly as the revision actions of
+	// each revision iteration, including any sector data, are sent to the
+	// host. It is passed the number of bytes sent so far and the total to be
+	// sent.
+	OnProgress func(bytesSent, total uint64)
+
+	// PriceLeeway is the fraction by which upload prices are increased (and
+	// collateral decreased) to tolerate small discrepancies between the
+	// renter and host, such as differing block heights. It defaults to
+	// hostPriceLeeway.
+	PriceLeeway float64
+
+	// MaxPriceLeeway, if greater than PriceLeeway, is the leeway used to
+	// retry an upload once if the host rejects it for underpaying. Since the
+	// host ends the revision loop when it rejects a revision, the Editor
+	// reconnects before retrying.
+	MaxPriceLeeway float64
+
+	// StrictPricing, if set, disables PriceLeeway regardless of host
+	// version, reproducing the exact prices paid to hosts at or below
+	// v1.0.1.
+	StrictPricing bool
+
+	// QueueDepth is the number of uploads that QueueUpload buffers before
+	// applying the full-queue policy. It defaults to defaultQueueDepth, and
+	// has no effect once QueueUpload has been called.
+	QueueDepth int
+
+	// RejectFullQueue, if set, makes QueueUpload fail with ErrQueueFull when
+	// the queue is full, rather than blocking until there is room.
+	RejectFullQueue bool
+}
+
+// now returns the current time according to the Editor's clock.
+func (he *Editor) now() time.Time {
+	if he.clock == nil {
+		return time.Now()
+	}
+	return he.clock.Now()
+}
+
+// afterFunc calls f in its own goroutine after d has elapsed according to
+// the Editor's clock.
+func (he *Editor) afterFunc(d time.Duration, f func()) timer {
+	if he.clock == nil {
+		return time.AfterFunc(d, f)
+	}
+	return he.clock.AfterFunc(d, f)
+}
+
+// extendDeadline extends the deadline of the Editor's connection to d from
+// now.
+func (he *Editor) extendDeadline(d time.Duration) { _ = he.conn.SetDeadline(he.now().Add(d)) }
+
+// logf logs a message, if the Editor has a logger.
+func (he *Editor) logf(format string, v ...interface{}) {
+	if he.log != nil {
+		he.log.Printf(format, v...)
+	}
 }
 
 // shutdown terminates the revision loop and signals the goroutine spawned in
 // NewEditor to return.
 func (he *Editor) shutdown() {
-	extendDeadline(he.conn, modules.NegotiateSettingsTime)
-	// don't care about these errors
-	_, _ = verifySettings(he.conn, he.host)
-	_ = modules.WriteNegotiationStop(he.conn)
+	he.extendDeadline(closeTimeout)
+	// these errors are only logged, since the connection is being closed
+	// regardless
+	var settingsErr error
+	if !he.pendingSettings {
+		_, settingsErr = verifySettings(he.conn, he.host)
+	}
+	stopErr := modules.WriteNegotiationStop(he.conn)
+	if settingsErr != nil || stopErr != nil {
+		he.logf("could not gracefully close editor for host %v: %v, %v", he.host.NetAddress, settingsErr, stopErr)
+	}
 	close(he.closeChan)
 }
 
 // Close cleanly terminates the revision loop with the host and closes the
-// connection.
+// connection. It should be called when the caller is done with the Editor.
 func (he *Editor) Close() error {
 	// using once ensures that Close is idempotent
 	he.once.Do(he.shutdown)
 	return he.conn.Close()
 }
 
+// Abort closes the connection immediately, skipping the graceful shutdown
+// performed by Close. It is intended for callers abandoning the session for
+// their own reasons (e.g. the host was deselected or the allowance is
+// exhausted); since the host is not at fault, a revision interrupted by Abort
+// is not recorded as a failed interaction. Unlike the other Editor methods,
+// Abort may be called concurrently with an in-progress Upload.
+func (he *Editor) Abort() error {
+	atomic.StoreInt32(&he.aborted, 1)
+	he.connMu.Lock()
+	defer he.connMu.Unlock()
+	he.once.Do(func() { close(he.closeChan) })
+	return he.conn.Close()
+}
+
+// RefreshSettings returns the host's current settings and updates the
+// Editor's copy of them, so that subsequent uploads are priced accordingly.
+// The host sends its settings at the start of each revision iteration, so
+// RefreshSettings reads them early rather than performing a separate RPC;
+// this costs part of a round-trip, and the host only waits a limited time for
+// the iteration to continue. Calling RefreshSettings again before the next
+// revision returns the same settings.
+func (he *Editor) RefreshSettings() (modules.HostExternalSettings, error) {
+	if he.stopped {
+		return modules.HostExternalSettings{}, ErrHostStopped
+	} else if he.pendingSettings {
+		return he.host.HostExternalSettings, nil
+	}
+	he.extendDeadline(modules.NegotiateSettingsTime)
+	defer he.extendDeadline(time.Hour)
+	host, err := verifySettings(he.conn, he.host)
+	if err != nil {
+		return modules.HostExternalSettings{}, err
+	}
+	he.host = host
+	he.pendingSettings = true
+	return host.HostExternalSettings, nil
+}
+
+// SetHost replaces the Editor's cached host entry, e.g. after the host has
+// been rescanned, so that subsequent uploads are priced and verified against
+// it. The entry's public key must match the current host's. The Editor always
+// dials the contract's NetAddress, so the entry's address is only reported in
+// logs.
+func (he *Editor) SetHost(host modules.HostDBEntry) error {
+	if host.PublicKey.String() != he.host.PublicKey.String() {
+		return errors.New("new host entry has a different public key")
+	}
+	he.host = host
+	return nil
+}
+
+// reconnect gracefully ends the current revision loop and starts a new one
+// with the host at addr, calling verify to perform the recent revision
+// exchange. If reconnect fails, or Abort is called while it is in progress,
+// the Editor is left closed.
+func (he *Editor) reconnect(addr modules.NetAddress, verify func(net.Conn) error) error {
+	he.Close()
+	addr, err := resolveAddress(he.resolver, addr)
+	if err != nil {
+		return err
+	}
+	conn, closeChan, err := initiateRevisionLoop(addr, he.cancel, he.wrapConn, he.now, verify)
+	if err != nil {
+		return err
+	}
+	he.connMu.Lock()
+	defer he.connMu.Unlock()
+	if atomic.LoadInt32(&he.aborted) == 1 {
+		conn.Close()
+		close(closeChan)
+		return errEditorAborted
+	}
+	he.conn, he.closeChan, he.once = newRateLimitedConn(conn, he.uploadRate), closeChan, sync.Once{}
+	he.stopped, he.pendingSettings = false, false
+	return nil
+}
+
+// RefreshRevision replaces the Editor's cached revision with the host's most
+// recent revision of the contract, e.g. after a revision mismatch caused by a
+// revision that was negotiated out-of-band. The host only reports its recent
+// revision at the start of the revise RPC, so RefreshRevision gracefully ends
+// the current revision loop and starts a new one, re-dialing the host. The
+// host's revision must carry valid signatures from both parties, must not be
+// older than the cached revision, and must have the same Merkle root, since
+// the Editor cannot recover sector roots it does not know about.
+func (he *Editor) RefreshRevision() (err error) {
+	if atomic.LoadInt32(&he.aborted) == 1 {
+		return errEditorAborted
+	}
+
+	// Increase Successful/Failed interactions accordingly
+	defer func() {
+		if err != nil {
+			he.logf("refresh of contract %v with host %v failed: %v", he.contract.ID, he.host.NetAddress, err)
+			he.hdb.IncrementFailedInteractions(he.contract.HostPublicKey)
+		} else {
+			he.hdb.IncrementSuccessfulInteractions(he.contract.HostPublicKey)
+		}
+	}()
+
+	var rev types.FileContractRevision
+	var sigs []types.TransactionSignature
+	err = he.reconnect(he.contract.NetAddress, func(conn net.Conn) (err error) {
+		rev, sigs, err = getRecentRevision(conn, he.contract, he.host.Version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := modules.VerifyFileContractRevisionTransactionSignatures(rev, sigs, he.contract.FileContract.WindowStart-1); err != nil {
+		return err
+	} else if rev.NewRevisionNumber < he.contract.LastRevision.NewRevisionNumber {
+		return &recentRevisionError{he.contract.LastRevision.NewRevisionNumber, rev.NewRevisionNumber}
+	} else if rev.NewFileMerkleRoot != he.contract.LastRevision.NewFileMerkleRoot {
+		return errors.New("host's revision has a different Merkle root")
+	}
+	he.contract.LastRevision = rev
+	he.contract.LastRevisionTxn = types.Transaction{
+		FileContractRevisions: []types.FileContractRevision{rev},
+		TransactionSignatures: sigs,
+	}
+	return nil
+}
+
+// Renew switches the Editor to newContract, typically the renewal of its
+// current contract, formed out-of-band with the same host. The revise RPC is
+// bound to a single contract, so the existing connection cannot be reused;
+// Renew ends the current revision loop and dials the host again, verifying
+// newContract's recent revision. The Editor's options, callbacks, and latency
+// statistics are retained. If Renew fails after dialing, the Editor is left
+// closed.
+func (he *Editor) Renew(newContract modules.RenterContract) (err error) {
+	if atomic.LoadInt32(&he.aborted) == 1 {
+		return errEditorAborted
+	} else if newContract.HostPublicKey.String() != he.contract.HostPublicKey.String() {
+		return errors.New("new contract was formed with a different host")
+	} else if len(newContract.LastRevision.NewValidProofOutputs) != 2 {
+		return errors.New("invalid contract")
+	}
+
+	// Increase Successful/Failed interactions accordingly
+	defer func() {
+		// a revision mismatch is not necessarily the host's fault
+		if err != nil && !IsRevisionMismatch(err) {
+			he.logf("renewal of contract %v with host %v failed: %v", he.contract.ID, he.host.NetAddress, err)
+			he.hdb.IncrementFailedInteractions(newContract.HostPublicKey)
+		} else if err == nil {
+			he.hdb.IncrementSuccessfulInteractions(newContract.HostPublicKey)
+		}
+	}()
+
+	err = he.reconnect(newContract.NetAddress, func(conn net.Conn) error {
+		return verifyRecentRevision(conn, newContract, he.host.Version)
+	})
+	if err != nil {
+		return err
+	}
+	he.contract = newContract
+	return nil
+}
+
+// trace passes the time elapsed since start to fn, if fn is set, and returns
+// the current time, marking the start of the next phase.
+func (he *Editor) trace(fn func(time.Duration), start time.Time) time.Time {
+	now := he.now()
+	if fn != nil {
+		fn(now.Sub(start))
+	}
+	return now
+}
+
+// latencySamples retains the most recent maxLatencySamples durations in a
+// ring buffer.
+type latencySamples struct {
+	samples []time.Duration
+	next    int
+	mu      sync.Mutex
+}
+
+// add records a duration, replacing the oldest if the buffer is full.
+func (ls *latencySamples) add(d time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.samples) < maxLatencySamples {
+		ls.samples = append(ls.samples, d)
+		return
+	}
+	ls.samples[ls.next] = d
+	ls.next = (ls.next + 1) % maxLatencySamples
+}
+
+// percentiles returns the 50th, 90th, and 99th percentiles of the recorded
+// durations, or zero if none have been recorded.
+func (ls *latencySamples) percentiles() (p50, p90, p99 time.Duration) {
+	ls.mu.Lock()
+	sorted := append([]time.Duration(nil), ls.samples...)
+	ls.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := func(q float64) time.Duration { return sorted[int(q*float64(len(sorted)-1))] }
+	return p(0.50), p(0.90), p(0.99)
+}
+
+// LatencyPercentiles returns the 50th, 90th, and 99th percentiles of the time
+// taken by the Editor's most recent successful uploads. Only the last
+// maxLatencySamples uploads are considered. It may be called concurrently with
+// other Editor methods.
+func (he *Editor) LatencyPercentiles() (p50, p90, p99 time.Duration) {
+	return he.latency.percentiles()
+}
+
+// RTT returns the time taken to connect to the host and verify its most
+// recent revision when the Editor was created. If the hostDB passed to
+// NewEditor has a RecordRTT method, the RTT is also reported to it.
+func (he *Editor) RTT() time.Duration {
+	return he.rtt
+}
+
+// signatureCoversRevision returns true if sig covers the first file contract
+// revision of its transaction.
+func signatureCoversRevision(sig types.TransactionSignature) bool {
+	if sig.CoveredFields.WholeTransaction {
+		return true
+	}
+	for _, i := range sig.CoveredFields.FileContractRevisions {
+		if i == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // runRevisionIteration submits actions and their accompanying revision to the
 // host for approval. If negotiation is successful, it updates the underlying
 // Contract.
 func (he *Editor) runRevisionIteration(actions []modules.RevisionAction, rev types.FileContractRevision, newRoots []crypto.Hash) (err error) {
+	if he.stopped {
+		return ErrHostStopped
+	}
 	defer func() {
-		// Increase Successful/Failed interactions accordingly
-		if err != nil {
+		// Increase Successful/Failed interactions accordingly. Failures
+		// caused by Abort are not the host's fault.
+		if err != nil && atomic.LoadInt32(&he.aborted) == 1 {
+			he.logf("revision of contract %v with host %v aborted", he.contract.ID, he.host.NetAddress)
+		} else if err != nil {
+			he.logf("revision of contract %v with host %v failed: %v", he.contract.ID, he.host.NetAddress, err)
 			he.hdb.IncrementFailedInteractions(he.contract.HostPublicKey)
 		} else {
 			he.hdb.IncrementSuccessfulInteractions(he.contract.HostPublicKey)
 		}
 
 		// reset deadline
-		extendDeadline(he.conn, time.Hour)
+		he.extendDeadline(time.Hour)
 	}()
 
-	// initiate revision
-	extendDeadline(he.conn, modules.NegotiateSettingsTime)
-	if err := startRevision(he.conn, he.host); err != nil {
+	// initiate revision, unless RefreshSettings has already read the host's
+	// settings for this iteration
+	he.extendDeadline(modules.NegotiateSettingsTime)
+	if he.pendingSettings {
+		he.pendingSettings = false
+		if err := modules.WriteNegotiationAcceptance(he.conn); err != nil {
+			return err
+		}
+	} else if err := startRevision(he.conn, he.host); err != nil {
 		return err
 	}
 
@@ -107,22 +541,53 @@ func (he *Editor) runRevisionIteration(actions []modules.RevisionAction, rev typ
 	}
 
 	// send actions
-	extendDeadline(he.conn, modules.NegotiateFileContractRevisionTime)
-	if err := encoding.WriteObject(he.conn, actions); err != nil {
+	he.extendDeadline(modules.NegotiateFileContractRevisionTime)
+	start := he.now()
+	w := &retryWriter{
+		conn:    he.conn,
+		retries: he.sendRetries,
+		backoff: he.sendRetryBackoff,
+		timeout: modules.NegotiateFileContractRevisionTime,
+		now:     he.now,
+	}
+	var out io.Writer = w
+	b := encoding.Marshal(actions)
+	if he.OnProgress != nil {
+		out = &progressWriter{w: w, total: 8 + uint64(len(b)), fn: he.OnProgress}
+	}
+	if err := encoding.WritePrefix(out, b); err != nil {
 		return err
 	}
+	start = he.trace(he.OnSendActions, start)
 
 	// send revision to host and exchange signatures
-	extendDeadline(he.conn, 2*time.Minute)
-	signedTxn, err := negotiateRevision(he.conn, rev, he.contract.SecretKey)
+	he.extendDeadline(2 * time.Minute)
+	signedTxn, err := sendRevision(he.conn, rev, he.contract.SecretKey)
+	if err != nil {
+		return err
+	}
+	start = he.trace(he.OnSendRevision, start)
+	signedTxn, err = receiveRevisionSignature(he.conn, signedTxn)
+	he.trace(he.OnReceiveSignature, start)
 	if err == modules.ErrStopResponse {
-		// if host gracefully closed, close our connection as well; this will
-		// cause the next operation to fail
+		// The host commits the revision before sending StopResponse, so
+		// the revision is still recorded below. The host will not process
+		// further iterations, so close our connection as well and fail
+		// subsequent operations with ErrHostStopped.
+		he.logf("host %v terminated the revision loop", he.host.NetAddress)
+		he.stopped = true
 		he.conn.Close()
 	} else if err != nil {
 		return err
 	}
 
+	// the host signs the renter's revision rather than returning its own,
+	// so a valid signature commits the host to the renter's Merkle root, but
+	// only if it covers the revision
+	if !signatureCoversRevision(signedTxn.TransactionSignatures[1]) {
+		return ErrRootMismatch
+	}
+
 	// update host contract
 	he.contract.LastRevision = rev
 	he.contract.LastRevisionTxn = signedTxn
@@ -131,55 +596,364 @@ func (he *Editor) runRevisionIteration(actions []modules.RevisionAction, rev typ
 	return nil
 }
 
-// Upload negotiates a revision that adds a sector to a file contract.
-func (he *Editor) Upload(data []byte) (modules.RenterContract, crypto.Hash, error) {
-	// calculate price
+// uploadPrices calculates the storage price, bandwidth price, and collateral
+// of uploading a single sector to the host.
+func (he *Editor) uploadPrices() (storagePrice, bandwidthPrice, collateral types.Currency) {
 	// TODO: height is never updated, so we'll wind up overpaying on long-running uploads
 	blockBytes := types.NewCurrency64(modules.SectorSize * uint64(he.contract.FileContract.WindowEnd-he.height))
-	sectorStoragePrice := he.host.StoragePrice.Mul(blockBytes)
-	sectorBandwidthPrice := he.host.UploadBandwidthPrice.Mul64(modules.SectorSize)
-	sectorCollateral := he.host.Collateral.Mul(blockBytes)
+	storagePrice = he.host.StoragePrice.Mul(blockBytes)
+	bandwidthPrice = he.host.UploadBandwidthPrice.Mul64(modules.SectorSize)
+	collateral = he.host.Collateral.Mul(blockBytes)
 
 	// to mitigate small errors (e.g. differing block heights), fudge the
-	// price and collateral by 0.2%. This is only applied to hosts above
-	// v1.0.1; older hosts use stricter math.
-	if build.VersionCmp(he.host.Version, "1.0.1") > 0 {
-		sectorStoragePrice = sectorStoragePrice.MulFloat(1 + hostPriceLeeway)
-		sectorBandwidthPrice = sectorBandwidthPrice.MulFloat(1 + hostPriceLeeway)
-		sectorCollateral = sectorCollateral.MulFloat(1 - hostPriceLeeway)
+	// price and collateral by PriceLeeway. This is only applied to hosts
+	// above v1.0.1; older hosts use stricter math, which can also be forced
+	// via StrictPricing.
+	if !he.StrictPricing && build.VersionCmp(he.host.Version, "1.0.1") > 0 {
+		storagePrice = storagePrice.MulFloat(1 + he.PriceLeeway)
+		bandwidthPrice = bandwidthPrice.MulFloat(1 + he.PriceLeeway)
+		collateral = collateral.MulFloat(1 - he.PriceLeeway)
 	}
+	return storagePrice, bandwidthPrice, collateral
+}
 
-	sectorPrice := sectorStoragePrice.Add(sectorBandwidthPrice)
-	if he.contract.RenterFunds().Cmp(sectorPrice) < 0 {
-		return modules.RenterContract{}, crypto.Hash{}, errors.New("contract has insufficient funds to support upload")
+// priceRejections are the rejections sent by hosts whose view of the upload
+// price exceeds the renter's.
+var priceRejections = []string{
+	"rejected for low paying host valid output",
+	"rejected for low paying host missed output",
+	"rejected for high paying renter valid output",
+	"rejected for high paying renter missed output",
+}
+
+// isPriceRejection returns true if err was caused by the host rejecting a
+// revision that paid it too little.
+func isPriceRejection(err error) bool {
+	if err == nil {
+		return false
 	}
-	if he.contract.LastRevision.NewMissedProofOutputs[1].Value.Cmp(sectorCollateral) < 0 {
-		return modules.RenterContract{}, crypto.Hash{}, errors.New("contract has insufficient collateral to support upload")
+	for _, r := range priceRejections {
+		if strings.Contains(err.Error(), r) {
+			return true
+		}
 	}
+	return false
+}
 
-	// calculate the new Merkle root
-	sectorRoot := crypto.MerkleRoot(data)
-	newRoots := append(he.contract.MerkleRoots, sectorRoot)
+// ProjectCost returns the amount that the renter would pay to upload the
+// specified number of sectors, using the same prices as Upload. Since the
+// Editor's height is fixed, every sector is priced for the full remaining
+// duration of the contract. Collateral is not included, as it is posted by
+// the host.
+func (he *Editor) ProjectCost(sectors uint64) (types.Currency, error) {
+	if he.height >= he.contract.FileContract.WindowEnd {
+		return types.ZeroCurrency, ErrContractExpired
+	}
+	storagePrice, bandwidthPrice, _ := he.uploadPrices()
+	return storagePrice.Add(bandwidthPrice).Mul64(sectors), nil
+}
+
+// Upload negotiates a revision that adds a sector to a file contract.
+func (he *Editor) Upload(data []byte) (modules.RenterContract, crypto.Hash, error) {
+	contract, roots, err := he.upload([][]byte{data})
+	if err != nil {
+		return modules.RenterContract{}, crypto.Hash{}, err
+	}
+	return contract, roots[0], nil
+}
+
+// UploadPrecomputed is like Upload, but uses the provided root of data
+// instead of computing it, for callers that have already hashed the sector.
+// The root is only verified in debug builds, so the caller must ensure that it
+// is correct: a wrong root corrupts the contract's Merkle roots, causing
+// storage proofs and later revisions to fail.
+func (he *Editor) UploadPrecomputed(data []byte, root crypto.Hash) (modules.RenterContract, error) {
+	contract, _, err := he.uploadAt(uint64(len(he.contract.MerkleRoots)), [][]byte{data}, []crypto.Hash{root})
+	if err != nil {
+		return modules.RenterContract{}, err
+	}
+	return contract, nil
+}
+
+// UploadOnto is like Upload, but builds the new revision on base rather than
+// on the contract's last revision, for callers that have learned of a newer
+// revision out-of-band. base must be a revision of the same contract, no
+// older than its last revision, and must cover the same sectors as the
+// contract's Merkle roots. If the upload fails, the contract's last revision
+// is unchanged. An upload rejected for underpaying is not retried with
+// MaxPriceLeeway, since the retry would replace base with the host's
+// revision.
+func (he *Editor) UploadOnto(base types.FileContractRevision, data []byte) (modules.RenterContract, crypto.Hash, error) {
+	if base.ParentID != he.contract.LastRevision.ParentID {
+		return modules.RenterContract{}, crypto.Hash{}, errors.New("base revision is for a different contract")
+	} else if base.NewRevisionNumber < he.contract.LastRevision.NewRevisionNumber {
+		return modules.RenterContract{}, crypto.Hash{}, errors.New("base revision is older than the contract's last revision")
+	} else if base.NewFileMerkleRoot != cachedMerkleRoot(he.contract.MerkleRoots) {
+		return modules.RenterContract{}, crypto.Hash{}, errors.New("base revision does not cover the contract's sectors")
+	} else if base.NewFileSize != uint64(len(he.contract.MerkleRoots))*modules.SectorSize {
+		return modules.RenterContract{}, crypto.Hash{}, errors.New("base revision has the wrong file size")
+	}
+	defer func(leeway float64) { he.MaxPriceLeeway = leeway }(he.MaxPriceLeeway)
+	he.MaxPriceLeeway = 0
+	old := he.contract.LastRevision
+	he.contract.LastRevision = base
+	contract, root, err := he.Upload(data)
+	if err != nil {
+		he.contract.LastRevision = old
+		return modules.RenterContract{}, crypto.Hash{}, err
+	}
+	return contract, root, nil
+}
+
+// UploadTimeout is like Upload, but bounds the total time spent negotiating
+// the revision by max. If max elapses before the revision completes, the
+// connection is closed, which interrupts the revision and terminates the
+// revision loop, and ErrUploadTimeout is returned. If max elapses just after
+// the revision completes, the revision is kept, but the connection is still
+// closed, so the revised contract is returned along with ErrUploadTimeout.
+func (he *Editor) UploadTimeout(data []byte, max time.Duration) (modules.RenterContract, crypto.Hash, error) {
+	t := he.afterFunc(max, func() {
+		he.connMu.Lock()
+		defer he.connMu.Unlock()
+		he.conn.Close()
+	})
+	contract, root, err := he.Upload(data)
+	if !t.Stop() {
+		if err == nil {
+			return contract, root, ErrUploadTimeout
+		}
+		return modules.RenterContract{}, crypto.Hash{}, ErrUploadTimeout
+	}
+	return contract, root, err
+}
+
+// UploadAt negotiates a revision that inserts a sector into a file contract
+// at the specified index, shifting the sectors at and after index. An index
+// equal to the number of sectors in the contract appends the sector, as if by
+// Upload.
+func (he *Editor) UploadAt(index uint64, data []byte) (modules.RenterContract, crypto.Hash, error) {
+	contract, roots, err := he.uploadAt(index, [][]byte{data}, nil)
+	if err != nil {
+		return modules.RenterContract{}, crypto.Hash{}, err
+	}
+	return contract, roots[0], nil
+}
+
+// UploadCompressed negotiates a revision that adds a sector containing data
+// compressed by codec to a file contract. The sector's root covers the stored
+// (compressed) bytes, so host storage proofs remain valid. If the compressed
+// data does not fit in a sector, the raw data is stored instead. Either way,
+// the sector's header records whether it was compressed, so a downloaded
+// sector can always be passed to DecompressSector. data must not exceed
+// MaxCompressedUploadSize.
+func (he *Editor) UploadCompressed(data []byte, codec Codec) (modules.RenterContract, crypto.Hash, error) {
+	if uint64(len(data)) > MaxCompressedUploadSize {
+		return modules.RenterContract{}, crypto.Hash{}, errors.New("data exceeds MaxCompressedUploadSize")
+	}
+	sector, err := compressSector(data, codec)
+	if err != nil {
+		return modules.RenterContract{}, crypto.Hash{}, err
+	}
+	return he.Upload(sector)
+}
+
+// UploadBatchDurable negotiates a single revision that adds multiple sectors
+// to a file contract. Unlike calling Upload once per sector, the revision is
+// only saved (via SaveFn) once for the whole batch. The batch is
+// all-or-nothing: if the revision fails, or the renter crashes before the
+// host's signature is received, none of the sectors in the batch can be
+// considered stored, and the entire batch must be uploaded again. The
+// encoded batch must not exceed the host's MaxReviseBatchSize, nor
+// encoding.MaxObjectSize.
+func (he *Editor) UploadBatchDurable(sectors [][]byte) (modules.RenterContract, []crypto.Hash, error) {
+	if len(sectors) == 0 {
+		return he.contract, nil, nil
+	}
+	// each encoded action is a fixed-size header followed by its data
+	actionOverhead := uint64(len(encoding.Marshal(modules.RevisionAction{})))
+	batchSize := uint64(8) // slice length prefix
+	for _, data := range sectors {
+		batchSize += actionOverhead + uint64(len(data))
+	}
+	if batchSize > he.host.MaxReviseBatchSize {
+		return modules.RenterContract{}, nil, errors.New("batch exceeds host's MaxReviseBatchSize")
+	} else if batchSize > encoding.MaxObjectSize {
+		return modules.RenterContract{}, nil, encoding.ErrObjectTooLarge
+	}
+	return he.upload(sectors)
+}
+
+// DedupUpload uploads data via one of editors, which should all be
+// connected to the same host, unless one of their contracts already stores
+// it. If a contract already contains the sector, its ID is returned and
+// nothing is uploaded; otherwise, the sector is uploaded using the editor
+// with the lowest upload price, breaking ties by contract ID.
+func DedupUpload(editors map[types.FileContractID]*Editor, data []byte) (types.FileContractID, crypto.Hash, error) {
+	if len(editors) == 0 {
+		return types.FileContractID{}, crypto.Hash{}, errors.New("no editors to upload with")
+	}
+	// visit the editors in a deterministic order
+	ids := make([]types.FileContractID, 0, len(editors))
+	for id := range editors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	root := crypto.MerkleRoot(data)
+	for _, id := range ids {
+		for _, r := range editors[id].contract.MerkleRoots {
+			if r == root {
+				return id, root, nil
+			}
+		}
+	}
+
+	var cheapest types.FileContractID
+	var cheapestPrice types.Currency
+	for i, id := range ids {
+		storagePrice, bandwidthPrice, _ := editors[id].uploadPrices()
+		if price := storagePrice.Add(bandwidthPrice); i == 0 || price.Cmp(cheapestPrice) < 0 {
+			cheapest, cheapestPrice = id, price
+		}
+	}
+	if _, _, err := editors[cheapest].Upload(data); err != nil {
+		return types.FileContractID{}, crypto.Hash{}, err
+	}
+	return cheapest, root, nil
+}
+
+// UploadAll uploads each sector in turn, as if by Upload, calling checkpoint
+// (if non-nil) with the number of sectors uploaded so far after each one is
+// committed. If an error occurs, the roots of the sectors uploaded so far are
+// returned along with it; an interrupted upload can be resumed by calling
+// UploadAll again with the remaining sectors.
+func UploadAll(he *Editor, sectors [][]byte, checkpoint func(done int)) ([]crypto.Hash, error) {
+	roots := make([]crypto.Hash, 0, len(sectors))
+	for _, data := range sectors {
+		_, root, err := he.Upload(data)
+		if err != nil {
+			return roots, err
+		}
+		roots = append(roots, root)
+		if checkpoint != nil {
+			checkpoint(len(roots))
+		}
+	}
+	return roots, nil
+}
+
+// upload negotiates a revision that appends the provided sectors to a file
+// contract.
+func (he *Editor) upload(sectors [][]byte) (modules.RenterContract, []crypto.Hash, error) {
+	return he.uploadAt(uint64(len(he.contract.MerkleRoots)), sectors, nil)
+}
+
+// uploadAt negotiates a revision that inserts the provided sectors into a
+// file contract, starting at index. If sectorRoots is nil, the roots of the
+// sectors are computed; otherwise, they are trusted.
+func (he *Editor) uploadAt(index uint64, sectors [][]byte, sectorRoots []crypto.Hash) (modules.RenterContract, []crypto.Hash, error) {
+	// the storage price is proportional to the blocks remaining in the
+	// contract, which must be positive
+	if he.height >= he.contract.FileContract.WindowEnd {
+		return modules.RenterContract{}, nil, ErrContractExpired
+	}
+	if index > uint64(len(he.contract.MerkleRoots)) {
+		return modules.RenterContract{}, nil, errors.New("sector index out of range")
+	}
+
+	// calculate price
+	sectorStoragePrice, sectorBandwidthPrice, sectorCollateral := he.uploadPrices()
+	numSectors := uint64(len(sectors))
+	storagePrice := sectorStoragePrice.Mul64(numSectors)
+	bandwidthPrice := sectorBandwidthPrice.Mul64(numSectors)
+	collateral := sectorCollateral.Mul64(numSectors)
+	price := storagePrice.Add(bandwidthPrice)
+	if he.contract.RenterFunds().Cmp(price) < 0 {
+		return modules.RenterContract{}, nil, errors.New("contract has insufficient funds to support upload")
+	}
+	if he.contract.LastRevision.NewMissedProofOutputs[1].Value.Cmp(collateral) < 0 {
+		return modules.RenterContract{}, nil, errors.New("contract has insufficient collateral to support upload")
+	}
+
+	// calculate the new Merkle root and create the actions
+	if sectorRoots == nil {
+		sectorRoots = make([]crypto.Hash, len(sectors))
+		for i, data := range sectors {
+			sectorRoots[i] = crypto.MerkleRoot(data)
+		}
+	} else if build.DEBUG {
+		for i, data := range sectors {
+			if crypto.MerkleRoot(data) != sectorRoots[i] {
+				build.Critical("precomputed sector root is incorrect")
+			}
+		}
+	}
+	actions := make([]modules.RevisionAction, len(sectors))
+	// newRoots must not share memory with the contract's roots; otherwise,
+	// appending to it could overwrite roots held by previous callers, even if
+	// the revision fails
+	oldRoots := he.contract.MerkleRoots
+	newRoots := make([]crypto.Hash, len(oldRoots)+len(sectors))
+	copy(newRoots, oldRoots[:index])
+	copy(newRoots[index+numSectors:], oldRoots[index:])
+	for i, data := range sectors {
+		actions[i] = modules.RevisionAction{
+			Type:        modules.ActionInsert,
+			SectorIndex: index + uint64(i),
+			Data:        data,
+		}
+		newRoots[index+uint64(i)] = sectorRoots[i]
+	}
 	merkleRoot := cachedMerkleRoot(newRoots)
 
-	// create the action and revision
-	actions := []modules.RevisionAction{{
-		Type:        modules.ActionInsert,
-		SectorIndex: uint64(len(he.contract.MerkleRoots)),
-		Data:        data,
-	}}
-	rev := newUploadRevision(he.contract.LastRevision, merkleRoot, sectorPrice, sectorCollateral)
+	// create the revision; newUploadRevision accounts for the size of a
+	// single sector, so account for the rest of the batch
+	rev := newUploadRevision(he.contract.LastRevision, merkleRoot, price, collateral)
+	rev.NewFileSize += (numSectors - 1) * modules.SectorSize
 
 	// run the revision iteration
-	if err := he.runRevisionIteration(actions, rev, newRoots); err != nil {
-		return modules.RenterContract{}, crypto.Hash{}, err
+	start := he.now()
+	if err := he.runRevisionIteration(actions, rev, newRoots); isPriceRejection(err) && he.MaxPriceLeeway > he.PriceLeeway {
+		// retry once with the larger leeway; the retry still checks that the
+		// contract can afford the higher price. The host ended the revision
+		// loop when it rejected the revision, so a new one is started. The
+		// host did not accept the revision, so the contract's last revision
+		// is still current, and the rejection has already been recorded as
+		// an interaction.
+		reconnectErr := he.reconnect(he.contract.NetAddress, func(conn net.Conn) error {
+			return verifyRecentRevision(conn, he.contract, he.host.Version)
+		})
+		if reconnectErr != nil {
+			return modules.RenterContract{}, nil, build.ComposeErrors(err, reconnectErr)
+		}
+		defer func(leeway float64) { he.PriceLeeway = leeway }(he.PriceLeeway)
+		he.PriceLeeway = he.MaxPriceLeeway
+		return he.uploadAt(index, sectors, sectorRoots)
+	} else if err != nil {
+		return modules.RenterContract{}, nil, err
 	}
+	he.latency.add(he.now().Sub(start))
 
 	// update metrics
-	he.contract.StorageSpending = he.contract.StorageSpending.Add(sectorStoragePrice)
-	he.contract.UploadSpending = he.contract.UploadSpending.Add(sectorBandwidthPrice)
+	he.contract.StorageSpending = he.contract.StorageSpending.Add(storagePrice)
+	he.contract.UploadSpending = he.contract.UploadSpending.Add(bandwidthPrice)
 
-	return he.contract, sectorRoot, nil
+	return he.contract, sectorRoots, nil
+}
+
+// UploadWithProof negotiates a revision that adds a sector to a file contract,
+// and additionally returns a Merkle proof that the sector is included in the
+// revised contract. The proof is valid against the NewFileMerkleRoot of the
+// returned contract's LastRevision.
+func (he *Editor) UploadWithProof(data []byte) (modules.RenterContract, crypto.Hash, []crypto.Hash, error) {
+	contract, sectorRoot, err := he.Upload(data)
+	if err != nil {
+		return modules.RenterContract{}, crypto.Hash{}, nil, err
+	}
+	proof := cachedMerkleProof(contract.MerkleRoots, uint64(len(contract.MerkleRoots)-1))
+	return contract, sectorRoot, proof, nil
 }
 
 // Delete negotiates a revision that removes a sector from a file contract.
@@ -257,31 +1031,87 @@ func (he *Editor) Modify(oldRoot, newRoot crypto.Hash, offset uint64, newData []
 	return he.contract, nil
 }
 
-// NewEditor initiates the contract revision process with a host, and returns
-// an Editor.
-func NewEditor(host modules.HostDBEntry, contract modules.RenterContract, currentHeight types.BlockHeight, hdb hostDB, cancel <-chan struct{}) (_ *Editor, err error) {
-	// check that contract has enough value to support an upload
-	if len(contract.LastRevision.NewValidProofOutputs) != 2 {
-		return nil, errors.New("invalid contract")
+// EditorOptions are optional parameters supplied to NewEditor. The zero value
+// uses the default behavior for each option.
+type EditorOptions struct {
+	// Gate, if set, is called before dialing the host. If it returns false,
+	// NewEditor returns ErrHostBlacklisted without contacting the host.
+	Gate func(modules.HostDBEntry) bool
+
+	// SendRetries is the number of times that sending revision actions will
+	// be retried after a transient network error, waiting SendRetryBackoff
+	// between each attempt. Permanent errors are never retried.
+	SendRetries      int
+	SendRetryBackoff time.Duration
+
+	// Log, if set, records graceful-close failures and failed revisions.
+	Log logger
+
+	// Breaker, if set, is consulted before dialing the host. If the host's
+	// circuit is open, NewEditor returns ErrHostCircuitOpen without
+	// contacting the host. The outcome of each attempt is recorded.
+	Breaker *HostBreaker
+
+	// UploadRate, if positive, limits the rate at which the Editor writes to
+	// the host, in bytes per second. Since sector data dominates the traffic,
+	// this effectively caps upload bandwidth.
+	UploadRate int64
+
+	// Resolver, if set, translates the contract's NetAddress into the
+	// address that is dialed, e.g. to reach in-process hosts on a private
+	// network. The NetAddress must still be valid.
+	Resolver func(modules.NetAddress) (string, error)
+
+	// WrapConn, if set, is applied to each connection to the host after it
+	// is dialed, and the Editor uses the returned connection for all
+	// subsequent communication, e.g. to layer an encrypted session over it.
+	// Closing the returned connection must close the original.
+	WrapConn func(net.Conn) (net.Conn, error)
+
+	// clock, if set, replaces the system clock for the Editor's deadlines
+	// and latency measurements, including the RTT measured by NewEditor.
+	clock clock
+}
+
+// resolveAddress translates addr using resolver, if it is set.
+func resolveAddress(resolver func(modules.NetAddress) (string, error), addr modules.NetAddress) (modules.NetAddress, error) {
+	if resolver == nil {
+		return addr, nil
+	}
+	resolved, err := resolver(addr)
+	if err != nil {
+		return "", errors.New("couldn't resolve host address: " + err.Error())
 	}
+	return modules.NetAddress(resolved), nil
+}
 
-	// Increase Successful/Failed interactions accordingly
-	defer func() {
-		// a revision mismatch is not necessarily the host's fault
-		if err != nil && !IsRevisionMismatch(err) {
-			hdb.IncrementFailedInteractions(contract.HostPublicKey)
-		} else if err == nil {
-			hdb.IncrementSuccessfulInteractions(contract.HostPublicKey)
-		}
-	}()
+// isCanceled returns true if cancel has been closed.
+func isCanceled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
 
-	// initiate revision loop
-	conn, err := (&net.Dialer{
-		Cancel:  cancel,
-		Timeout: 15 * time.Second,
-	}).Dial("tcp", string(contract.NetAddress))
+// initiateRevisionLoop dials the host at addr, wraps the connection with wrap
+// if it is set, and initiates the revise RPC, calling verify to perform the
+// recent revision exchange. Deadlines are set relative to now. It returns the
+// connection, which is closed if cancel is closed, and a channel that must be
+// closed once the connection is no longer in use.
+func initiateRevisionLoop(addr modules.NetAddress, cancel <-chan struct{}, wrap func(net.Conn) (net.Conn, error), now func() time.Time, verify func(net.Conn) error) (net.Conn, chan struct{}, error) {
+	conn, err := dialHost(addr, 15*time.Second, cancel)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if wrap != nil {
+		wrapped, err := wrap(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, errors.New("couldn't wrap connection: " + err.Error())
+		}
+		conn = wrapped
 	}
 
 	closeChan := make(chan struct{})
@@ -294,26 +1124,169 @@ func NewEditor(host modules.HostDBEntry, contract modules.RenterContract, curren
 	}()
 
 	// allot 2 minutes for RPC request + revision exchange
-	extendDeadline(conn, modules.NegotiateRecentRevisionTime)
-	defer extendDeadline(conn, time.Hour)
+	_ = conn.SetDeadline(now().Add(modules.NegotiateRecentRevisionTime))
+	defer func() { _ = conn.SetDeadline(now().Add(time.Hour)) }()
 	if err := encoding.WriteObject(conn, modules.RPCReviseContract); err != nil {
 		conn.Close()
 		close(closeChan)
-		return nil, errors.New("couldn't initiate RPC: " + err.Error())
+		return nil, nil, errors.New("couldn't initiate RPC: " + err.Error())
 	}
-	if err := verifyRecentRevision(conn, contract, host.Version); err != nil {
+	if err := verify(conn); err != nil {
 		conn.Close() // TODO: close gracefully if host has entered revision loop
 		close(closeChan)
+		return nil, nil, err
+	}
+	return conn, closeChan, nil
+}
+
+// NewEditor initiates the contract revision process with a host, and returns
+// an Editor.
+func NewEditor(host modules.HostDBEntry, contract modules.RenterContract, currentHeight types.BlockHeight, hdb hostDB, cancel <-chan struct{}, opts EditorOptions) (_ *Editor, err error) {
+	// check that contract has enough value to support an upload
+	if len(contract.LastRevision.NewValidProofOutputs) != 2 {
+		return nil, errors.New("invalid contract")
+	}
+	// check that the host is allowed and can be dialed; this is not counted
+	// as an interaction with the host
+	if contract.NetAddress.IsStdValid() != nil {
+		return nil, ErrInvalidHostAddress
+	} else if opts.Gate != nil && !opts.Gate(host) {
+		return nil, ErrHostBlacklisted
+	} else if opts.Breaker != nil && !opts.Breaker.allow(contract.HostPublicKey) {
+		return nil, ErrHostCircuitOpen
+	}
+
+	// Increase Successful/Failed interactions accordingly
+	defer func() {
+		// a revision mismatch is not necessarily the host's fault
+		if err != nil && !IsRevisionMismatch(err) {
+			hdb.IncrementFailedInteractions(contract.HostPublicKey)
+		} else if err == nil {
+			hdb.IncrementSuccessfulInteractions(contract.HostPublicKey)
+		}
+	}()
+
+	// initiate revision loop, measuring the time taken to dial the host and
+	// verify its revision
+	addr, err := resolveAddress(opts.Resolver, contract.NetAddress)
+	if err != nil {
 		return nil, err
 	}
+	now := time.Now
+	if opts.clock != nil {
+		now = opts.clock.Now
+	}
+	start := now()
+	conn, closeChan, err := initiateRevisionLoop(addr, cancel, opts.WrapConn, now, func(conn net.Conn) error {
+		return verifyRecentRevision(conn, contract, host.Version)
+	})
+	// only the outcome of dialing the host and verifying its revision is
+	// recorded with the breaker. A revision mismatch, or a dial interrupted
+	// by the caller closing cancel, says nothing about the host's health.
+	if opts.Breaker != nil && !IsRevisionMismatch(err) && !isCanceled(cancel) {
+		opts.Breaker.record(contract.HostPublicKey, err == nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rtt := now().Sub(start)
+	if r, ok := hdb.(rttRecorder); ok {
+		r.RecordRTT(contract.HostPublicKey, rtt)
+	}
 
 	// the host is now ready to accept revisions
 	return &Editor{
 		host:      host,
 		hdb:       hdb,
+		log:       opts.Log,
 		height:    currentHeight,
 		contract:  contract,
-		conn:      conn,
+		conn:      newRateLimitedConn(conn, opts.UploadRate),
 		closeChan: closeChan,
+		cancel:    cancel,
+		rtt:       rtt,
+		clock:     opts.clock,
+
+		sendRetries:      opts.SendRetries,
+		sendRetryBackoff: opts.SendRetryBackoff,
+		uploadRate:       opts.UploadRate,
+		resolver:         opts.Resolver,
+		wrapConn:         opts.WrapConn,
+
+		PriceLeeway: hostPriceLeeway,
+	}, nil
+}
+
+// editorState is the session state exported by ExportState.
+type editorState struct {
+	ID              types.FileContractID       `json:"id"`
+	LastRevision    types.FileContractRevision `json:"lastrevision"`
+	LastRevisionTxn types.Transaction          `json:"lastrevisiontxn"`
+	Host            modules.HostDBEntry        `json:"host"`
+	Height          types.BlockHeight          `json:"height"`
+	PendingSettings bool                       `json:"pendingsettings"`
+}
+
+// ExportState returns the state of the Editor's session, so that it can be
+// resumed by ImportEditorState, e.g. in another process that inherits the
+// Editor's connection. The contract's secret key and Merkle roots are not
+// included. The Editor must not be used after its state is exported.
+func (he *Editor) ExportState() []byte {
+	state, err := json.Marshal(editorState{
+		ID:              he.contract.ID,
+		LastRevision:    he.contract.LastRevision,
+		LastRevisionTxn: he.contract.LastRevisionTxn,
+		Host:            he.host,
+		Height:          he.height,
+		PendingSettings: he.pendingSettings,
+	})
+	if err != nil {
+		build.Critical("failed to marshal editor state:", err)
+	}
+	return state
+}
+
+// ImportEditorState returns an Editor that resumes a session exported by
+// ExportState over conn, which must be the connection used by the exporting
+// Editor. The secret key, Merkle roots, and spending of the contract are
+// taken from contractSet, in which the caller must hold the contract, as if
+// passing it to NewEditor.
+//
+// The host's recent revision is not re-verified, so the state is trusted:
+// it must come from the process that verified the host, over a channel that
+// an attacker cannot write to. The only check is that the exported revision
+// commits to the Merkle roots in contractSet.
+func ImportEditorState(conn net.Conn, state []byte, contractSet *ContractSet, hdb hostDB) (*Editor, error) {
+	var s editorState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, errors.New("couldn't decode editor state: " + err.Error())
+	}
+	contractSet.mu.Lock()
+	sc, ok := contractSet.contracts[s.ID]
+	var contract modules.RenterContract
+	if ok {
+		contract = copyContract(sc.RenterContract)
+	}
+	contractSet.mu.Unlock()
+	if !ok {
+		return nil, ErrContractNotFound
+	} else if s.LastRevision.ParentID != s.ID {
+		return nil, errors.New("exported revision is not of the exported contract")
+	} else if cachedMerkleRoot(contract.MerkleRoots) != s.LastRevision.NewFileMerkleRoot {
+		return nil, ErrMerkleRootMismatch
+	}
+	contract.LastRevision = s.LastRevision
+	contract.LastRevisionTxn = s.LastRevisionTxn
+
+	return &Editor{
+		host:            s.Host,
+		hdb:             hdb,
+		height:          s.Height,
+		contract:        contract,
+		conn:            conn,
+		closeChan:       make(chan struct{}),
+		pendingSettings: s.PendingSettings,
+
+		PriceLeeway: hostPriceLeeway,
 	}, nil
 }
@@ -0,0 +1,2009 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+	"github.com/NebulousLabs/Sia/types"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// testHostDB is a hostDB that counts interactions and records RTTs.
+type testHostDB struct {
+	successes int
+	failures  int
+	rtts      []time.Duration
+	mu        sync.Mutex
+}
+
+func (hdb *testHostDB) RecordRTT(_ types.SiaPublicKey, rtt time.Duration) {
+	hdb.mu.Lock()
+	hdb.rtts = append(hdb.rtts, rtt)
+	hdb.mu.Unlock()
+}
+
+func (hdb *testHostDB) IncrementSuccessfulInteractions(types.SiaPublicKey) {
+	hdb.mu.Lock()
+	hdb.successes++
+	hdb.mu.Unlock()
+}
+
+func (hdb *testHostDB) IncrementFailedInteractions(types.SiaPublicKey) {
+	hdb.mu.Lock()
+	hdb.failures++
+	hdb.mu.Unlock()
+}
+
+// testLogger is a logger that records each message.
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+// A testHost simulates the host side of the revision loop. It accepts every
+// revision proposed by the renter and tracks the resulting sector roots.
+type testHost struct {
+	entry modules.HostDBEntry
+	sk    crypto.SecretKey
+
+	roots   []crypto.Hash
+	sectors map[crypto.Hash][]byte
+	mu      sync.Mutex
+
+	// if set, the host's signature does not cover the revision
+	uncoveredSig bool
+	// if set, the host terminates the revision loop after one iteration
+	stopAfterOne bool
+	// if nonzero, the host rejects revisions that pay it less than this
+	minHostPayout types.Currency
+}
+
+// Roots returns the sector roots stored by the host.
+func (h *testHost) Roots() []crypto.Hash {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]crypto.Hash(nil), h.roots...)
+}
+
+// Sector returns the data of the sector with the specified root.
+func (h *testHost) Sector(root crypto.Hash) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sectors[root]
+}
+
+// applyActions applies a set of revision actions to the host's roots and
+// sectors.
+func (h *testHost) applyActions(actions []modules.RevisionAction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, action := range actions {
+		switch action.Type {
+		case modules.ActionInsert:
+			root := crypto.MerkleRoot(action.Data)
+			if h.sectors == nil {
+				h.sectors = make(map[crypto.Hash][]byte)
+			}
+			h.sectors[root] = action.Data
+			h.roots = append(h.roots[:action.SectorIndex], append([]crypto.Hash{root}, h.roots[action.SectorIndex:]...)...)
+		case modules.ActionDelete:
+			h.roots = append(h.roots[:action.SectorIndex], h.roots[action.SectorIndex+1:]...)
+		}
+	}
+}
+
+// serveRevisions handles revision iterations on conn until the renter
+// terminates the revision loop.
+func (h *testHost) serveRevisions(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := crypto.WriteSignedObject(conn, h.entry.HostExternalSettings, h.sk); err != nil {
+			return
+		}
+		if err := modules.ReadNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		var actions []modules.RevisionAction
+		var rev types.FileContractRevision
+		if err := encoding.ReadObject(conn, &actions, h.entry.MaxReviseBatchSize); err != nil {
+			return
+		}
+		if err := encoding.ReadObject(conn, &rev, modules.NegotiateMaxFileContractRevisionSize); err != nil {
+			return
+		}
+		h.mu.Lock()
+		minPayout := h.minHostPayout
+		h.mu.Unlock()
+		if rev.NewValidProofOutputs[1].Value.Cmp(minPayout) < 0 {
+			modules.WriteNegotiationRejection(conn, errors.New("rejected for low paying host valid output"))
+			return
+		}
+		if err := modules.WriteNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		var renterSig types.TransactionSignature
+		if err := encoding.ReadObject(conn, &renterSig, modules.NegotiateMaxTransactionSignatureSize); err != nil {
+			return
+		}
+		txn := types.Transaction{
+			FileContractRevisions: []types.FileContractRevision{rev},
+			TransactionSignatures: []types.TransactionSignature{renterSig, {
+				ParentID:       crypto.Hash(rev.ParentID),
+				CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+				PublicKeyIndex: 1,
+			}},
+		}
+		if h.uncoveredSig {
+			txn.TransactionSignatures[1].CoveredFields = types.CoveredFields{}
+		}
+		sig := crypto.SignHash(txn.SigHash(1), h.sk)
+		txn.TransactionSignatures[1].Signature = sig[:]
+		h.applyActions(actions)
+		if h.stopAfterOne {
+			modules.WriteNegotiationStop(conn)
+			encoding.WriteObject(conn, txn.TransactionSignatures[1])
+			return
+		}
+		if err := modules.WriteNegotiationAcceptance(conn); err != nil {
+			return
+		}
+		if err := encoding.WriteObject(conn, txn.TransactionSignatures[1]); err != nil {
+			return
+		}
+	}
+}
+
+// serveRecentRevision handles the start of the revise RPC on conn, sending
+// rev and sigs as the host's most recent revision, and then handles revision
+// iterations.
+func (h *testHost) serveRecentRevision(conn net.Conn, rev types.FileContractRevision, sigs []types.TransactionSignature) {
+	var id types.Specifier
+	var fcid types.FileContractID
+	var renterSig crypto.Signature
+	if err := encoding.ReadObject(conn, &id, 16); err != nil || id != modules.RPCReviseContract {
+		conn.Close()
+		return
+	} else if err := encoding.ReadObject(conn, &fcid, 32); err != nil {
+		conn.Close()
+		return
+	} else if err := encoding.WriteObject(conn, crypto.Hash{}); err != nil {
+		conn.Close()
+		return
+	} else if err := encoding.ReadObject(conn, &renterSig, 64); err != nil {
+		conn.Close()
+		return
+	} else if err := modules.WriteNegotiationAcceptance(conn); err != nil {
+		conn.Close()
+		return
+	} else if err := encoding.WriteObject(conn, rev); err != nil {
+		conn.Close()
+		return
+	} else if err := encoding.WriteObject(conn, sigs); err != nil {
+		conn.Close()
+		return
+	}
+	h.serveRevisions(conn)
+}
+
+// signRevision returns the renter and host signatures of rev.
+func signRevision(rev types.FileContractRevision, renterSK, hostSK crypto.SecretKey) []types.TransactionSignature {
+	txn := types.Transaction{
+		FileContractRevisions: []types.FileContractRevision{rev},
+		TransactionSignatures: []types.TransactionSignature{
+			{
+				ParentID:       crypto.Hash(rev.ParentID),
+				CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+				PublicKeyIndex: 0,
+			},
+			{
+				ParentID:       crypto.Hash(rev.ParentID),
+				CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+				PublicKeyIndex: 1,
+			},
+		},
+	}
+	renterSig := crypto.SignHash(txn.SigHash(0), renterSK)
+	hostSig := crypto.SignHash(txn.SigHash(1), hostSK)
+	txn.TransactionSignatures[0].Signature = renterSig[:]
+	txn.TransactionSignatures[1].Signature = hostSig[:]
+	return txn.TransactionSignatures
+}
+
+// newTestContract returns a contract between the renter and host that can
+// store data for 100 blocks.
+func newTestContract(renterSK crypto.SecretKey, renterPK, hostPK crypto.PublicKey) modules.RenterContract {
+	uc := types.UnlockConditions{
+		PublicKeys: []types.SiaPublicKey{
+			types.Ed25519PublicKey(renterPK),
+			types.Ed25519PublicKey(hostPK),
+		},
+		SignaturesRequired: 2,
+	}
+	funds := types.SiacoinPrecision.Mul64(1e3)
+	rev := types.FileContractRevision{
+		ParentID:          types.FileContractID{1},
+		UnlockConditions:  uc,
+		NewRevisionNumber: 1,
+		NewWindowStart:    100,
+		NewWindowEnd:      200,
+		NewValidProofOutputs: []types.SiacoinOutput{
+			{Value: funds},
+			{Value: funds},
+		},
+		NewMissedProofOutputs: []types.SiacoinOutput{
+			{Value: funds},
+			{Value: funds},
+			{Value: types.ZeroCurrency},
+		},
+		NewUnlockHash: uc.UnlockHash(),
+	}
+	return modules.RenterContract{
+		ID:            rev.ParentID,
+		HostPublicKey: types.Ed25519PublicKey(hostPK),
+		FileContract: types.FileContract{
+			WindowStart: rev.NewWindowStart,
+			WindowEnd:   rev.NewWindowEnd,
+		},
+		LastRevision: rev,
+		SecretKey:    renterSK,
+	}
+}
+
+// newTestEditor returns an Editor that is connected to a testHost.
+func newTestEditor(t testing.TB) (*Editor, *testHost) {
+	renterSK, renterPK := crypto.GenerateKeyPair()
+	hostSK, hostPK := crypto.GenerateKeyPair()
+	host := &testHost{sk: hostSK}
+	host.entry.PublicKey = types.Ed25519PublicKey(hostPK)
+	host.entry.NetAddress = "host.com:1234"
+	host.entry.Version = "1.3.0"
+	host.entry.MaxReviseBatchSize = 17 * (1 << 20)
+	host.entry.StoragePrice = types.NewCurrency64(1)
+	host.entry.UploadBandwidthPrice = types.NewCurrency64(1)
+	host.entry.Collateral = types.NewCurrency64(1)
+
+	rConn, hConn := net.Pipe()
+	go host.serveRevisions(hConn)
+	he := &Editor{
+		conn:        rConn,
+		closeChan:   make(chan struct{}),
+		host:        host.entry,
+		hdb:         new(testHostDB),
+		contract:    newTestContract(renterSK, renterPK, hostPK),
+		PriceLeeway: hostPriceLeeway,
+	}
+	return he, host
+}
+
+// TestCachedMerkleProof tests that a proof produced by cachedMerkleProof can
+// be combined with a segment proof to prove a segment's membership in the
+// contract's Merkle root.
+func TestCachedMerkleProof(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	sectors := make([][]byte, 3)
+	roots := make([]crypto.Hash, len(sectors))
+	for i := range sectors {
+		sectors[i] = fastrand.Bytes(int(modules.SectorSize))
+		roots[i] = crypto.MerkleRoot(sectors[i])
+	}
+	contractRoot := cachedMerkleRoot(roots)
+
+	segmentsPerSector := modules.SectorSize / crypto.SegmentSize
+	numSegments := segmentsPerSector * uint64(len(sectors))
+	for i := range sectors {
+		proof := cachedMerkleProof(roots, uint64(i))
+		base, hashSet := crypto.MerkleProof(sectors[i], 0)
+		hashSet = append(hashSet, proof...)
+		if !crypto.VerifySegment(base, hashSet, numSegments, uint64(i)*segmentsPerSector, contractRoot) {
+			t.Error("proof for sector", i, "did not verify")
+		}
+	}
+}
+
+// TestEditorPriceLeeway tests that the Editor's PriceLeeway is applied to
+// upload prices, and that a zero leeway produces strict pricing.
+func TestEditorPriceLeeway(t *testing.T) {
+	he := &Editor{PriceLeeway: hostPriceLeeway}
+	he.host.Version = "1.3.0"
+	he.host.StoragePrice = types.NewCurrency64(10)
+	he.host.UploadBandwidthPrice = types.NewCurrency64(20)
+	he.host.Collateral = types.NewCurrency64(30)
+	he.contract.FileContract.WindowEnd = 100
+	he.height = 10
+
+	blockBytes := types.NewCurrency64(modules.SectorSize * 90)
+	strictStorage := he.host.StoragePrice.Mul(blockBytes)
+	strictBandwidth := he.host.UploadBandwidthPrice.Mul64(modules.SectorSize)
+	strictCollateral := he.host.Collateral.Mul(blockBytes)
+
+	// the default leeway should overpay and undercollateralize
+	storage, bandwidth, collateral := he.uploadPrices()
+	if storage.Cmp(strictStorage) <= 0 || bandwidth.Cmp(strictBandwidth) <= 0 || collateral.Cmp(strictCollateral) >= 0 {
+		t.Fatal("default leeway was not applied:", storage, bandwidth, collateral)
+	}
+
+	// a zero leeway should produce strict prices
+	he.PriceLeeway = 0
+	storage, bandwidth, collateral = he.uploadPrices()
+	if storage.Cmp(strictStorage) != 0 || bandwidth.Cmp(strictBandwidth) != 0 || collateral.Cmp(strictCollateral) != 0 {
+		t.Fatal("zero leeway did not produce strict prices:", storage, bandwidth, collateral)
+	}
+	// strict pricing should ignore the leeway
+	he.PriceLeeway = hostPriceLeeway
+	he.StrictPricing = true
+	storage, bandwidth, collateral = he.uploadPrices()
+	if storage.Cmp(strictStorage) != 0 || bandwidth.Cmp(strictBandwidth) != 0 || collateral.Cmp(strictCollateral) != 0 {
+		t.Fatal("strict pricing did not produce strict prices:", storage, bandwidth, collateral)
+	}
+}
+
+// TestEditorUploadBatchDurable tests that a batch of sectors can be uploaded
+// in a single revision.
+func TestEditorUploadBatchDurable(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	he, host := newTestEditor(t)
+	defer he.Close()
+	var saves int
+	he.SaveFn = func(types.FileContractRevision, []crypto.Hash) error {
+		saves++
+		return nil
+	}
+
+	sectors := [][]byte{
+		fastrand.Bytes(int(modules.SectorSize)),
+		fastrand.Bytes(int(modules.SectorSize)),
+	}
+	contract, roots, err := he.UploadBatchDurable(sectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saves != 1 {
+		t.Fatal("expected revision to be saved once, got", saves)
+	}
+	if len(contract.MerkleRoots) != len(sectors) || contract.LastRevision.NewRevisionNumber != 2 {
+		t.Fatal("contract was not revised correctly")
+	}
+	if contract.LastRevision.NewFileSize != uint64(len(sectors))*modules.SectorSize {
+		t.Fatal("wrong file size:", contract.LastRevision.NewFileSize)
+	}
+	hostRoots := host.Roots()
+	for i := range sectors {
+		if roots[i] != crypto.MerkleRoot(sectors[i]) || hostRoots[i] != roots[i] {
+			t.Fatal("wrong root at index", i)
+		}
+	}
+
+	// a batch that exceeds the encoding limit should be rejected
+	tooLarge := make([][]byte, 3)
+	for i := range tooLarge {
+		tooLarge[i] = sectors[0]
+	}
+	if _, _, err := he.UploadBatchDurable(tooLarge); err == nil {
+		t.Fatal("expected oversized batch to be rejected")
+	}
+}
+
+// TestEditorTrace tests that the Editor's tracing callbacks are invoked in
+// order during a revision iteration.
+func TestEditorTrace(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+	var phases []string
+	he.OnSendActions = func(time.Duration) { phases = append(phases, "actions") }
+	he.OnSendRevision = func(time.Duration) { phases = append(phases, "revision") }
+	he.OnReceiveSignature = func(time.Duration) { phases = append(phases, "signature") }
+
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"actions", "revision", "signature"}; !reflect.DeepEqual(phases, exp) {
+		t.Fatalf("expected phases %v, got %v", exp, phases)
+	}
+}
+
+// TestNewEditorGate tests that NewEditor does not dial a host rejected by the
+// Gate.
+func TestNewEditorGate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{})
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+			close(dialed)
+		}
+	}()
+
+	he, _ := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	contract.NetAddress = modules.NetAddress(l.Addr().String())
+	hdb := new(testHostDB)
+	gate := func(modules.HostDBEntry) bool { return false }
+	_, err = NewEditor(he.host, contract, 0, hdb, nil, EditorOptions{Gate: gate})
+	if err != ErrHostBlacklisted {
+		t.Fatal("expected ErrHostBlacklisted, got", err)
+	}
+	select {
+	case <-dialed:
+		t.Fatal("NewEditor dialed a blacklisted host")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if hdb.successes != 0 || hdb.failures != 0 {
+		t.Fatal("NewEditor recorded an interaction with a blacklisted host")
+	}
+}
+
+// TestEditorLog tests that the Editor logs failed revisions and graceful-close
+// failures.
+func TestEditorLog(t *testing.T) {
+	he, _ := newTestEditor(t)
+	l := new(testLogger)
+	he.log = l
+
+	// a successful upload should not be logged
+	data := fastrand.Bytes(int(modules.SectorSize))
+	if _, _, err := he.Upload(data); err != nil {
+		t.Fatal(err)
+	} else if len(l.msgs) != 0 {
+		t.Fatal("expected no log messages, got", l.msgs)
+	}
+
+	// close the connection out from under the Editor
+	he.conn.Close()
+	if _, _, err := he.Upload(data); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	he.Close()
+	if len(l.msgs) != 2 {
+		t.Fatal("expected 2 log messages, got", l.msgs)
+	} else if !strings.Contains(l.msgs[0], "revision of contract") || !strings.Contains(l.msgs[1], "could not gracefully close") {
+		t.Fatal("unexpected log messages:", l.msgs)
+	}
+}
+
+// TestEditorAbort tests that Abort interrupts an in-progress upload without
+// recording a failed interaction.
+func TestEditorAbort(t *testing.T) {
+	he, host := newTestEditor(t)
+	hdb := he.hdb.(*testHostDB)
+
+	// stall the host so that the upload is in progress when Abort is called
+	host.mu.Lock()
+	errChan := make(chan error)
+	go func() {
+		_, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+		errChan <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := he.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("expected upload to fail after Abort")
+	}
+	host.mu.Unlock()
+
+	// Close should be a no-op after Abort
+	he.Close()
+	if hdb.failures != 0 {
+		t.Fatal("Abort should not record a failed interaction")
+	}
+}
+
+// TestEditorUploadCompressed tests that data uploaded by UploadCompressed can
+// be downloaded and decompressed.
+func TestEditorUploadCompressed(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+
+	tests := []struct {
+		data       []byte
+		compressed bool
+	}{
+		{bytes.Repeat([]byte("foo"), int(MaxCompressedUploadSize)/3), true},
+		{fastrand.Bytes(int(MaxCompressedUploadSize)), false},
+		{fastrand.Bytes(100), false}, // short, incompressible
+		{nil, true},
+	}
+	var roots []crypto.Hash
+	for _, test := range tests {
+		_, root, err := he.UploadCompressed(test.data, GzipCodec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sector := host.Sector(root)
+		if uint64(len(sector)) != modules.SectorSize {
+			t.Fatal("expected a full sector to be stored, got", len(sector))
+		} else if crypto.MerkleRoot(sector) != root {
+			t.Fatal("root does not cover the stored sector")
+		} else if (sector[0] == sectorMarkerCompressed) != test.compressed {
+			t.Fatal("wrong marker for data of length", len(test.data))
+		}
+		roots = append(roots, root)
+	}
+
+	// download each sector and decompress it
+	rConn, hConn := net.Pipe()
+	go host.serveDownloads(hConn)
+	hd := &Downloader{
+		conn:      rConn,
+		closeChan: make(chan struct{}),
+		host:      host.entry,
+		hdb:       new(testHostDB),
+		contract:  he.contract,
+	}
+	defer hd.Close()
+	for i, test := range tests {
+		_, sector, err := hd.Sector(roots[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := DecompressSector(sector, GzipCodec{})
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, test.data) {
+			t.Fatal("decompressed data does not match original of length", len(test.data))
+		}
+	}
+
+	// data that cannot be stored raw should be rejected
+	if _, _, err := he.UploadCompressed(fastrand.Bytes(int(modules.SectorSize)), GzipCodec{}); err == nil {
+		t.Fatal("expected oversized data to be rejected")
+	}
+
+	if _, err := DecompressSector(make([]byte, 4), GzipCodec{}); err != errCompressedSectorMalformed {
+		t.Fatal("expected errCompressedSectorMalformed, got", err)
+	}
+	bad := make([]byte, modules.SectorSize)
+	bad[0] = 7
+	if _, err := DecompressSector(bad, GzipCodec{}); err != errCompressedSectorMalformed {
+		t.Fatal("expected errCompressedSectorMalformed for unknown marker, got", err)
+	}
+}
+
+// TestEditorRefreshRevision tests that RefreshRevision adopts a revision that
+// the host negotiated out-of-band.
+func TestEditorRefreshRevision(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	hdb := he.hdb.(*testHostDB)
+
+	// advance the host's revision, as if by a download
+	rev := he.contract.LastRevision
+	rev.NewRevisionNumber += 5
+	payment := types.SiacoinPrecision
+	rev.NewValidProofOutputs = []types.SiacoinOutput{
+		{Value: rev.NewValidProofOutputs[0].Value.Sub(payment)},
+		{Value: rev.NewValidProofOutputs[1].Value.Add(payment)},
+	}
+	rev.NewMissedProofOutputs = []types.SiacoinOutput{
+		{Value: rev.NewMissedProofOutputs[0].Value.Sub(payment)},
+		rev.NewMissedProofOutputs[1],
+		{Value: rev.NewMissedProofOutputs[2].Value.Add(payment)},
+	}
+	sigs := signRevision(rev, he.contract.SecretKey, host.sk)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go host.serveRecentRevision(conn, rev, sigs)
+		}
+	}()
+	he.contract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	if err := he.RefreshRevision(); err != nil {
+		t.Fatal(err)
+	} else if he.contract.LastRevision.NewRevisionNumber != rev.NewRevisionNumber {
+		t.Fatal("expected revision to be refreshed")
+	}
+	// the next upload should build on the refreshed revision
+	contract, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if contract.LastRevision.NewRevisionNumber != rev.NewRevisionNumber+1 {
+		t.Fatal("upload did not build on refreshed revision")
+	} else if contract.RenterFunds().Cmp(rev.NewValidProofOutputs[0].Value) >= 0 {
+		t.Fatal("upload did not spend from refreshed revision")
+	}
+
+	// the host still reports the out-of-band revision, which is now older
+	// than ours, and so cannot be adopted
+	ours := he.contract.LastRevision
+	if err := he.RefreshRevision(); !IsRevisionMismatch(err) {
+		t.Fatal("expected revision mismatch, got", err)
+	} else if he.contract.LastRevision.NewRevisionNumber != ours.NewRevisionNumber {
+		t.Fatal("rejected revision should not be adopted")
+	}
+	hdb.mu.Lock()
+	defer hdb.mu.Unlock()
+	if hdb.failures != 1 {
+		t.Fatal("expected 1 failed interaction, got", hdb.failures)
+	}
+}
+
+// TestLatencySamples tests that latencySamples computes percentiles over a
+// bounded window of samples.
+func TestLatencySamples(t *testing.T) {
+	var ls latencySamples
+	if p50, p90, p99 := ls.percentiles(); p50 != 0 || p90 != 0 || p99 != 0 {
+		t.Fatal("expected zero percentiles with no samples")
+	}
+	for i := 1; i <= 100; i++ {
+		ls.add(time.Duration(i))
+	}
+	if p50, p90, p99 := ls.percentiles(); p50 != 50 || p90 != 90 || p99 != 99 {
+		t.Fatalf("unexpected percentiles: %v %v %v", p50, p90, p99)
+	}
+
+	// old samples should be evicted
+	for i := 0; i < maxLatencySamples; i++ {
+		ls.add(time.Hour)
+	}
+	if len(ls.samples) != maxLatencySamples {
+		t.Fatal("expected samples to be bounded, got", len(ls.samples))
+	} else if p50, _, _ := ls.percentiles(); p50 != time.Hour {
+		t.Fatal("expected old samples to be evicted, got p50 of", p50)
+	}
+
+	// uploads should be recorded
+	he, _ := newTestEditor(t)
+	defer he.Close()
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	} else if p50, _, _ := he.LatencyPercentiles(); p50 == 0 {
+		t.Fatal("expected upload latency to be recorded")
+	}
+}
+
+// TestEditorRootMismatch tests that the Editor rejects a host signature that
+// does not commit to the renter's Merkle root.
+func TestEditorRootMismatch(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	host.uncoveredSig = true
+
+	_, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != ErrRootMismatch {
+		t.Fatal("expected ErrRootMismatch, got", err)
+	} else if len(he.contract.MerkleRoots) != 0 || he.contract.LastRevision.NewRevisionNumber != 1 {
+		t.Fatal("rejected upload should not be recorded")
+	} else if he.hdb.(*testHostDB).failures != 1 {
+		t.Fatal("expected a failed interaction to be recorded")
+	}
+}
+
+// TestEditorRenew tests that Renew switches the Editor to a new contract with
+// the same host.
+func TestEditorRenew(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+
+	// form the renewed contract
+	renterSK := he.contract.SecretKey
+	newContract := newTestContract(renterSK, renterSK.PublicKey(), host.sk.PublicKey())
+	newContract.ID = types.FileContractID{2}
+	newContract.LastRevision.ParentID = newContract.ID
+	sigs := signRevision(newContract.LastRevision, renterSK, host.sk)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go host.serveRecentRevision(conn, newContract.LastRevision, sigs)
+		}
+	}()
+	newContract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	// a contract with a different host should be rejected
+	other := newContract
+	other.HostPublicKey = types.SiaPublicKey{Algorithm: types.SignatureEd25519, Key: []byte{1}}
+	if err := he.Renew(other); err == nil {
+		t.Fatal("expected Renew to reject a contract with a different host")
+	}
+
+	if err := he.Renew(newContract); err != nil {
+		t.Fatal(err)
+	}
+	contract, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if contract.ID != newContract.ID || len(contract.MerkleRoots) != 1 {
+		t.Fatal("upload was not applied to the new contract")
+	}
+}
+
+// TestEditorUploadNoAlias tests that a failed upload does not modify the
+// contract's Merkle roots, even if they have spare capacity.
+func TestEditorUploadNoAlias(t *testing.T) {
+	he, _ := newTestEditor(t)
+	roots := make([]crypto.Hash, 1, 10)
+	roots[0] = crypto.Hash{1}
+	he.contract.MerkleRoots = roots
+
+	// fail the negotiation
+	he.conn.Close()
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	he.Close()
+	if len(he.contract.MerkleRoots) != 1 {
+		t.Fatal("failed upload changed the number of roots:", len(he.contract.MerkleRoots))
+	} else if roots[:2][1] != (crypto.Hash{}) {
+		t.Fatal("failed upload wrote to the contract's roots")
+	}
+}
+
+// TestEditorUploadExpired tests that uploading to an expired contract fails
+// without contacting the host.
+func TestEditorUploadExpired(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	he.height = he.contract.FileContract.WindowEnd
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != ErrContractExpired {
+		t.Fatal("expected ErrContractExpired, got", err)
+	} else if len(host.Roots()) != 0 {
+		t.Fatal("host should not have received the sector")
+	}
+	hdb := he.hdb.(*testHostDB)
+	if hdb.successes != 0 || hdb.failures != 0 {
+		t.Fatal("expired upload should not be recorded as an interaction")
+	}
+}
+
+// TestEditorUploadAt tests that UploadAt inserts sectors at the specified
+// index.
+func TestEditorUploadAt(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+
+	// append two sectors, then insert one between them
+	var roots []crypto.Hash
+	for i := uint64(0); i < 2; i++ {
+		_, root, err := he.UploadAt(i, fastrand.Bytes(int(modules.SectorSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	contract, root, err := he.UploadAt(1, fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []crypto.Hash{roots[0], root, roots[1]}
+	if !reflect.DeepEqual([]crypto.Hash(contract.MerkleRoots), exp) {
+		t.Fatal("sector was not inserted at the correct index")
+	} else if !reflect.DeepEqual(host.Roots(), exp) {
+		t.Fatal("host roots do not match renter roots")
+	} else if contract.LastRevision.NewFileMerkleRoot != cachedMerkleRoot(exp) {
+		t.Fatal("revision has wrong Merkle root")
+	} else if contract.LastRevision.NewFileSize != 3*modules.SectorSize {
+		t.Fatal("revision has wrong file size:", contract.LastRevision.NewFileSize)
+	}
+
+	// an index past the end should be rejected
+	if _, _, err := he.UploadAt(4, fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected out-of-range index to be rejected")
+	}
+}
+
+// TestEditorHostStopped tests that a revision during which the host
+// terminates the revision loop is recorded, and that subsequent operations
+// fail with ErrHostStopped.
+func TestEditorHostStopped(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	host.stopAfterOne = true
+
+	contract, root, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contract.MerkleRoots) != 1 || contract.MerkleRoots[0] != root {
+		t.Fatal("revision committed by the host was not recorded")
+	}
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != ErrHostStopped {
+		t.Fatal("expected ErrHostStopped, got", err)
+	} else if hdb := he.hdb.(*testHostDB); hdb.failures != 0 {
+		t.Fatal("ErrHostStopped should not be recorded as a failed interaction")
+	}
+}
+
+// TestEditorUploadTimeout tests that UploadTimeout interrupts a stalled
+// upload.
+func TestEditorUploadTimeout(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	data := fastrand.Bytes(int(modules.SectorSize))
+	if _, _, err := he.UploadTimeout(data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// stall the host
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	start := time.Now()
+	if _, _, err := he.UploadTimeout(data, 100*time.Millisecond); err != ErrUploadTimeout {
+		t.Fatal("expected ErrUploadTimeout, got", err)
+	} else if time.Since(start) > 5*time.Second {
+		t.Fatal("UploadTimeout did not return promptly")
+	} else if len(he.contract.MerkleRoots) != 1 {
+		t.Fatal("timed-out upload should not be recorded")
+	}
+}
+
+// TestEditorUploadTimeoutLate tests that UploadTimeout reports the closed
+// connection if the timeout elapses after the upload succeeds.
+func TestEditorUploadTimeoutLate(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+	he.clock = lateClock{}
+	contract, _, err := he.UploadTimeout(fastrand.Bytes(int(modules.SectorSize)), time.Minute)
+	if err != ErrUploadTimeout {
+		t.Fatal("expected ErrUploadTimeout, got", err)
+	} else if len(contract.MerkleRoots) != 1 || len(he.contract.MerkleRoots) != 1 {
+		t.Fatal("completed upload should be recorded")
+	}
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected upload on closed connection to fail")
+	}
+}
+
+// TestEditorUploadPrecomputed tests that UploadPrecomputed uses the provided
+// sector root.
+func TestEditorUploadPrecomputed(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	data := fastrand.Bytes(int(modules.SectorSize))
+	root := crypto.MerkleRoot(data)
+	contract, err := he.UploadPrecomputed(data, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contract.MerkleRoots) != 1 || contract.MerkleRoots[0] != root {
+		t.Fatal("contract does not contain the precomputed root")
+	} else if !reflect.DeepEqual(host.Roots(), []crypto.Hash{root}) {
+		t.Fatal("host does not have the sector")
+	}
+}
+
+// TestNewEditorBreaker tests that NewEditor stops dialing a host that fails
+// repeatedly, and resumes after the cooldown.
+func TestNewEditorBreaker(t *testing.T) {
+	// get an address that refuses connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	he, _ := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	contract.NetAddress = modules.NetAddress(addr)
+	hdb := new(testHostDB)
+	breaker, err := NewHostBreaker(3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClock{time.Now()}
+	breaker.clock = c
+	opts := EditorOptions{Breaker: breaker}
+
+	// failures that are not the host's fault should not be recorded
+	resolverOpts := opts
+	resolverOpts.Resolver = func(modules.NetAddress) (string, error) {
+		return "", errors.New("resolver failed")
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	for i := 0; i < 3; i++ {
+		if _, err := NewEditor(he.host, contract, 0, hdb, nil, resolverOpts); err == nil {
+			t.Fatal("expected resolver to fail")
+		} else if _, err := NewEditor(he.host, contract, 0, hdb, cancel, opts); err == nil || err == ErrHostCircuitOpen {
+			t.Fatal("expected canceled dial to fail, got", err)
+		}
+	}
+	hdb = new(testHostDB)
+
+	for i := 0; i < 3; i++ {
+		if _, err := NewEditor(he.host, contract, 0, hdb, nil, opts); err == nil || err == ErrHostCircuitOpen {
+			t.Fatal("expected dial to fail, got", err)
+		}
+	}
+	if _, err := NewEditor(he.host, contract, 0, hdb, nil, opts); err != ErrHostCircuitOpen {
+		t.Fatal("expected ErrHostCircuitOpen, got", err)
+	} else if hdb.failures != 3 {
+		t.Fatal("an open circuit should not be recorded as an interaction")
+	}
+
+	// after the cooldown, a single attempt is allowed through
+	c.now = c.now.Add(time.Minute)
+	if _, err := NewEditor(he.host, contract, 0, hdb, nil, opts); err == ErrHostCircuitOpen {
+		t.Fatal("expected attempt after cooldown")
+	}
+	if _, err := NewEditor(he.host, contract, 0, hdb, nil, opts); err != ErrHostCircuitOpen {
+		t.Fatal("expected circuit to reopen after a failed attempt, got", err)
+	}
+
+	// a success resets the host's failures
+	breaker.record(contract.HostPublicKey, true)
+	if !breaker.allow(contract.HostPublicKey) {
+		t.Fatal("expected circuit to close after a success")
+	}
+	breaker.record(contract.HostPublicKey, false)
+	if !breaker.allow(contract.HostPublicKey) {
+		t.Fatal("a single failure should not reopen the circuit")
+	}
+}
+
+// TestNewEditorBreakerMismatch tests that a revision mismatch neither counts
+// as a failure nor resets the host's failures.
+func TestNewEditorBreakerMismatch(t *testing.T) {
+	he, host := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	rev := contract.LastRevision
+	rev.NewRevisionNumber++
+	sigs := signRevision(rev, contract.SecretKey, host.sk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(conn, rev, sigs)
+		}
+	}()
+	contract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	breaker, err := NewHostBreaker(3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breaker.record(contract.HostPublicKey, false)
+	breaker.record(contract.HostPublicKey, false)
+	_, err = NewEditor(he.host, contract, 0, new(testHostDB), nil, EditorOptions{Breaker: breaker})
+	if !IsRevisionMismatch(err) {
+		t.Fatal("expected revision mismatch, got", err)
+	}
+	breaker.record(contract.HostPublicKey, false)
+	if breaker.allow(contract.HostPublicKey) {
+		t.Fatal("revision mismatch should not reset the host's failures")
+	}
+}
+
+// TestNewHostBreakerInvalid tests that NewHostBreaker rejects invalid
+// thresholds and cooldowns.
+func TestNewHostBreakerInvalid(t *testing.T) {
+	if _, err := NewHostBreaker(0, time.Minute); err == nil {
+		t.Fatal("expected zero threshold to be rejected")
+	} else if _, err := NewHostBreaker(1, 0); err == nil {
+		t.Fatal("expected zero cooldown to be rejected")
+	}
+}
+
+// TestHostBreakerHalfOpen tests that only a single attempt is allowed through
+// after the cooldown, until its outcome is recorded.
+func TestHostBreakerHalfOpen(t *testing.T) {
+	breaker, err := NewHostBreaker(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClock{time.Now()}
+	breaker.clock = c
+	host := types.SiaPublicKey{Key: []byte{1}}
+	breaker.record(host, false)
+	if breaker.allow(host) {
+		t.Fatal("expected circuit to open")
+	}
+
+	c.now = c.now.Add(time.Minute)
+	if !breaker.allow(host) {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	for i := 0; i < 3; i++ {
+		if breaker.allow(host) {
+			t.Fatal("only one probe should be allowed through")
+		}
+	}
+
+	// if the probe fails, the cooldown starts again
+	breaker.record(host, false)
+	c.now = c.now.Add(time.Minute - 1)
+	if breaker.allow(host) {
+		t.Fatal("expected circuit to stay open after a failed probe")
+	}
+	c.now = c.now.Add(1)
+	if !breaker.allow(host) {
+		t.Fatal("expected a probe after the cooldown")
+	}
+
+	// if it succeeds, the circuit closes
+	breaker.record(host, true)
+	if !breaker.allow(host) || !breaker.allow(host) {
+		t.Fatal("expected circuit to close after a successful probe")
+	}
+}
+
+// TestEditorRefreshSettings tests that RefreshSettings updates the prices
+// used for subsequent uploads.
+func TestEditorRefreshSettings(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+
+	// make the Editor's copy of the host's prices stale
+	he.host.StoragePrice = types.NewCurrency64(5)
+	settings, err := he.RefreshSettings()
+	if err != nil {
+		t.Fatal(err)
+	} else if !settings.StoragePrice.Equals(host.entry.StoragePrice) || !he.host.StoragePrice.Equals(host.entry.StoragePrice) {
+		t.Fatal("settings were not refreshed:", settings.StoragePrice)
+	}
+	// refreshing again should not wait for another iteration
+	if _, err := he.RefreshSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next upload should use the refreshed prices
+	expStorage, _, _ := he.uploadPrices()
+	contract, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if !contract.StorageSpending.Equals(expStorage) {
+		t.Fatal("upload did not use refreshed prices")
+	}
+
+	// closing with settings pending should terminate the loop cleanly
+	if _, err := he.RefreshSettings(); err != nil {
+		t.Fatal(err)
+	}
+	l := new(testLogger)
+	he.log = l
+	he.Close()
+	if len(l.msgs) != 0 {
+		t.Fatal("expected a clean close, got", l.msgs)
+	}
+}
+
+// TestEditorQueueUpload tests that queued uploads are performed in order, and
+// that a full queue is rejected if RejectFullQueue is set.
+func TestEditorQueueUpload(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+
+	var results []<-chan UploadResult
+	var exp []crypto.Hash
+	for i := 0; i < 5; i++ {
+		data := fastrand.Bytes(int(modules.SectorSize))
+		exp = append(exp, crypto.MerkleRoot(data))
+		results = append(results, he.QueueUpload(data))
+	}
+	for i, c := range results {
+		r := <-c
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		} else if r.Root != exp[i] {
+			t.Fatal("upload", i, "returned wrong root")
+		}
+	}
+	if !reflect.DeepEqual(host.Roots(), exp) {
+		t.Fatal("uploads were not performed in order")
+	}
+
+	// block the first upload in the queue, so that the next one fills it
+	he, host = newTestEditor(t)
+	defer he.Close()
+	he.QueueDepth = 1
+	he.RejectFullQueue = true
+	started, release := make(chan struct{}), make(chan struct{})
+	he.OnSendActions = func(time.Duration) {
+		he.OnSendActions = nil
+		close(started)
+		<-release
+	}
+	first := he.QueueUpload(fastrand.Bytes(int(modules.SectorSize)))
+	<-started
+	second := he.QueueUpload(fastrand.Bytes(int(modules.SectorSize)))
+	if r := <-he.QueueUpload(fastrand.Bytes(int(modules.SectorSize))); r.Err != ErrQueueFull {
+		t.Fatal("expected ErrQueueFull, got", r.Err)
+	}
+	close(release)
+	for _, c := range []<-chan UploadResult{first, second} {
+		if r := <-c; r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	if len(host.Roots()) != 2 {
+		t.Fatal("expected 2 sectors, got", len(host.Roots()))
+	}
+}
+
+// fakeClock is a clock that always reports the same time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time { return c.now }
+
+// AfterFunc never calls f, since the clock never advances.
+func (c fakeClock) AfterFunc(time.Duration, func()) timer { return stoppedTimer{} }
+
+// stoppedTimer is a timer that never fires.
+type stoppedTimer struct{}
+
+func (stoppedTimer) Stop() bool { return true }
+
+// lateClock is a clock whose timers fire just as they are stopped,
+// reproducing a timeout that elapses after the work it bounds has finished.
+type lateClock struct {
+	fakeClock
+}
+
+func (c lateClock) AfterFunc(_ time.Duration, f func()) timer { return lateTimer(f) }
+
+// lateTimer is a timer that fires when it is stopped.
+type lateTimer func()
+
+func (t lateTimer) Stop() bool {
+	t()
+	return false
+}
+
+// deadlineConn is a net.Conn that records the deadlines set on it. The
+// deadlines are not forwarded to the underlying conn, so that a fake clock
+// cannot cause it to time out.
+type deadlineConn struct {
+	net.Conn
+	deadlines []time.Time
+	mu        sync.Mutex
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *deadlineConn) Deadlines() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time(nil), c.deadlines...)
+}
+
+// TestEditorClock tests that the Editor computes deadlines and latencies
+// using its clock.
+func TestEditorClock(t *testing.T) {
+	he, _ := newTestEditor(t)
+	conn := &deadlineConn{Conn: he.conn}
+	he.conn = conn
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	he.clock = fakeClock{now}
+
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+	exp := []time.Time{
+		now.Add(modules.NegotiateSettingsTime),
+		now.Add(modules.NegotiateFileContractRevisionTime),
+		now.Add(2 * time.Minute),
+		now.Add(time.Hour),
+	}
+	if d := conn.Deadlines(); !reflect.DeepEqual(d, exp) {
+		t.Fatal("wrong deadlines during upload:", d)
+	}
+	if p50, p90, p99 := he.LatencyPercentiles(); p50 != 0 || p90 != 0 || p99 != 0 {
+		t.Fatal("latency should be zero with a stopped clock:", p50, p90, p99)
+	}
+
+	he.Close()
+	exp = append(exp, now.Add(closeTimeout))
+	if d := conn.Deadlines(); !reflect.DeepEqual(d, exp) {
+		t.Fatal("wrong deadlines after close:", d)
+	}
+}
+
+// TestUploadAll tests that UploadAll checkpoints after each sector and
+// returns the sectors uploaded before an error.
+func TestUploadAll(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+
+	sectors := make([][]byte, 3)
+	for i := range sectors {
+		sectors[i] = fastrand.Bytes(int(modules.SectorSize))
+	}
+	var checkpoints []int
+	roots, err := UploadAll(he, sectors, func(done int) {
+		checkpoints = append(checkpoints, done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(checkpoints, []int{1, 2, 3}) {
+		t.Fatal("wrong checkpoints:", checkpoints)
+	} else if !reflect.DeepEqual(roots, host.Roots()) {
+		t.Fatal("returned roots do not match host roots")
+	}
+
+	// if the host stops after the first sector, only its root is returned
+	he, host = newTestEditor(t)
+	defer he.Close()
+	host.stopAfterOne = true
+	checkpoints = nil
+	roots, err = UploadAll(he, sectors, func(done int) {
+		checkpoints = append(checkpoints, done)
+	})
+	if err != ErrHostStopped {
+		t.Fatal("expected ErrHostStopped, got", err)
+	} else if !reflect.DeepEqual(roots, []crypto.Hash{crypto.MerkleRoot(sectors[0])}) {
+		t.Fatal("expected root of first sector, got", roots)
+	} else if !reflect.DeepEqual(checkpoints, []int{1}) {
+		t.Fatal("wrong checkpoints:", checkpoints)
+	}
+}
+
+// TestNewEditorInvalidAddress tests that NewEditor rejects malformed host
+// addresses without contacting the host.
+func TestNewEditorInvalidAddress(t *testing.T) {
+	he, _ := newTestEditor(t)
+	he.Close()
+	for _, addr := range []modules.NetAddress{"", "host.com", "host.com:", "host.com:0"} {
+		contract := he.contract
+		contract.NetAddress = addr
+		hdb := new(testHostDB)
+		if _, err := NewEditor(he.host, contract, 0, hdb, nil, EditorOptions{}); err != ErrInvalidHostAddress {
+			t.Errorf("%q: expected ErrInvalidHostAddress, got %v", addr, err)
+		} else if hdb.successes != 0 || hdb.failures != 0 {
+			t.Errorf("%q: NewEditor recorded an interaction with the host", addr)
+		}
+	}
+}
+
+// TestEditorSpending tests that uploads accumulate storage and upload
+// spending matching the per-sector prices paid.
+func TestEditorSpending(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+	initialFunds := he.contract.RenterFunds()
+
+	storagePrice, bandwidthPrice, _ := he.uploadPrices()
+	var contract modules.RenterContract
+	for i := 0; i < 3; i++ {
+		var err error
+		contract, _, err = he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !contract.StorageSpending.Equals(storagePrice.Mul64(3)) {
+		t.Fatal("wrong storage spending:", contract.StorageSpending)
+	} else if !contract.UploadSpending.Equals(bandwidthPrice.Mul64(3)) {
+		t.Fatal("wrong upload spending:", contract.UploadSpending)
+	} else if !contract.DownloadSpending.IsZero() {
+		t.Fatal("uploads should not incur download spending")
+	}
+	spent := contract.StorageSpending.Add(contract.UploadSpending)
+	if !initialFunds.Sub(contract.RenterFunds()).Equals(spent) {
+		t.Fatal("spending does not account for the funds paid to the host")
+	}
+}
+
+// TestNewEditorRTT tests that NewEditor measures the time taken to connect to
+// the host and reports it to the hostDB.
+func TestNewEditorRTT(t *testing.T) {
+	he, host := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	sigs := signRevision(contract.LastRevision, contract.SecretKey, host.sk)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(conn, contract.LastRevision, sigs)
+		}
+	}()
+	contract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	hdb := new(testHostDB)
+	he, err = NewEditor(he.host, contract, 0, hdb, nil, EditorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he.Close()
+	if he.RTT() <= 0 {
+		t.Fatal("expected a positive RTT, got", he.RTT())
+	} else if !reflect.DeepEqual(hdb.rtts, []time.Duration{he.RTT()}) {
+		t.Fatal("RTT was not reported to the hostDB:", hdb.rtts)
+	}
+
+	// the RTT should be measured using the Editor's clock
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(conn, contract.LastRevision, sigs)
+		}
+	}()
+	hdb = new(testHostDB)
+	he2, err := NewEditor(he.host, contract, 0, hdb, nil, EditorOptions{clock: fakeClock{time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he2.Close()
+	if he2.RTT() != 0 {
+		t.Fatal("RTT should be zero with a stopped clock, got", he2.RTT())
+	} else if !reflect.DeepEqual(hdb.rtts, []time.Duration{0}) {
+		t.Fatal("RTT was not reported to the hostDB:", hdb.rtts)
+	}
+}
+
+// TestEditorCloseUnresponsive tests that Close does not wait long for a host
+// that has stopped responding.
+func TestEditorCloseUnresponsive(t *testing.T) {
+	defer func(old time.Duration) { closeTimeout = old }(closeTimeout)
+	closeTimeout = 100 * time.Millisecond
+
+	he, _ := newTestEditor(t)
+	he.conn.Close()
+	rConn, hConn := net.Pipe()
+	defer hConn.Close() // hConn never reads or writes
+	he.conn = rConn
+	l := new(testLogger)
+	he.log = l
+
+	start := time.Now()
+	he.Close()
+	if elapsed := time.Since(start); elapsed > 5*closeTimeout {
+		t.Fatal("Close took too long:", elapsed)
+	} else if len(l.msgs) == 0 {
+		t.Fatal("expected the failed graceful close to be logged")
+	}
+	if _, err := rConn.Write([]byte{0}); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
+
+// TestDedupUpload tests that DedupUpload skips sectors that are already
+// stored, and otherwise uploads using the cheapest editor.
+func TestDedupUpload(t *testing.T) {
+	he1, host1 := newTestEditor(t)
+	defer he1.Close()
+	he2, host2 := newTestEditor(t)
+	defer he2.Close()
+	he1.contract.ID = types.FileContractID{1}
+	he2.contract.ID = types.FileContractID{2}
+	editors := map[types.FileContractID]*Editor{
+		he1.contract.ID: he1,
+		he2.contract.ID: he2,
+	}
+
+	// the sector is already stored in the second contract
+	data := fastrand.Bytes(int(modules.SectorSize))
+	if _, _, err := he2.Upload(data); err != nil {
+		t.Fatal(err)
+	}
+	id, root, err := DedupUpload(editors, data)
+	if err != nil {
+		t.Fatal(err)
+	} else if id != he2.contract.ID || root != crypto.MerkleRoot(data) {
+		t.Fatal("expected existing sector in second contract, got", id)
+	} else if len(host1.Roots()) != 0 || len(host2.Roots()) != 1 {
+		t.Fatal("sector was uploaded again")
+	}
+
+	// a new sector should be uploaded using the cheaper editor
+	he1.host.StoragePrice = he1.host.StoragePrice.Mul64(2)
+	data = fastrand.Bytes(int(modules.SectorSize))
+	if id, _, err := DedupUpload(editors, data); err != nil {
+		t.Fatal(err)
+	} else if id != he2.contract.ID {
+		t.Fatal("expected upload to cheaper contract, got", id)
+	} else if len(host1.Roots()) != 0 || len(host2.Roots()) != 2 {
+		t.Fatal("sector was not uploaded to the cheaper contract")
+	}
+}
+
+// TestUploadParallel tests that UploadParallel spreads sectors across
+// editors and fails over to another editor when one fails.
+func TestUploadParallel(t *testing.T) {
+	sectors := make([][]byte, 6)
+	for i := range sectors {
+		sectors[i] = fastrand.Bytes(int(modules.SectorSize))
+	}
+	checkStored := func(results []SectorResult, editors []*Editor) {
+		t.Helper()
+		for i, r := range results {
+			if r.Err != nil {
+				t.Fatal("sector", i, "failed:", r.Err)
+			} else if r.Root != crypto.MerkleRoot(sectors[i]) {
+				t.Fatal("sector", i, "has wrong root")
+			}
+			found := false
+			for _, he := range editors {
+				if he.contract.ID == r.ContractID && reflect.DeepEqual(he.contract.HostPublicKey, r.Host) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatal("sector", i, "reports wrong contract or host")
+			}
+		}
+	}
+
+	var editors []*Editor
+	for i := 0; i < 3; i++ {
+		he, _ := newTestEditor(t)
+		defer he.Close()
+		he.contract.ID = types.FileContractID{byte(i)}
+		editors = append(editors, he)
+	}
+	results := UploadParallel(editors, sectors, ParallelUploadOptions{Concurrency: 2})
+	checkStored(results, editors)
+	total := 0
+	for _, he := range editors {
+		total += len(he.contract.MerkleRoots)
+	}
+	if total != len(sectors) {
+		t.Fatal("expected each sector to be stored once, got", total)
+	}
+
+	// an editor whose contract has expired fails, and its sector should be
+	// uploaded by the other editor
+	bad, _ := newTestEditor(t)
+	defer bad.Close()
+	bad.height = bad.contract.FileContract.WindowEnd
+	good, _ := newTestEditor(t)
+	defer good.Close()
+	results = UploadParallel([]*Editor{bad, good}, sectors, ParallelUploadOptions{})
+	checkStored(results, []*Editor{good})
+	if len(good.contract.MerkleRoots) != len(sectors) {
+		t.Fatal("expected all sectors to be stored by the good editor")
+	}
+
+	// without retries, the failed sector is reported
+	bad, _ = newTestEditor(t)
+	defer bad.Close()
+	bad.height = bad.contract.FileContract.WindowEnd
+	good, _ = newTestEditor(t)
+	defer good.Close()
+	results = UploadParallel([]*Editor{bad, good}, sectors, ParallelUploadOptions{MaxAttempts: 1})
+	failed := 0
+	for i, r := range results {
+		if r.Err == ErrContractExpired {
+			failed++
+		} else if r.Err != nil {
+			t.Fatal("sector", i, "failed:", r.Err)
+		}
+	}
+	if failed > 1 || len(good.contract.MerkleRoots) != len(sectors)-failed {
+		t.Fatal("wrong number of failures:", failed)
+	}
+
+	// if every editor fails, every sector should report an error
+	for _, he := range []*Editor{bad, good} {
+		he.height = he.contract.FileContract.WindowEnd
+	}
+	for i, r := range UploadParallel([]*Editor{bad, good}, sectors, ParallelUploadOptions{}) {
+		if r.Err == nil {
+			t.Fatal("sector", i, "should have failed")
+		}
+	}
+}
+
+// TestSectorTreeHeight tests that SectorTreeHeight is log2 of the number of
+// segments in a sector.
+func TestSectorTreeHeight(t *testing.T) {
+	h := SectorTreeHeight()
+	if uint64(1)<<h != modules.SectorSize/crypto.SegmentSize {
+		t.Fatalf("tree of height %v does not cover %v segments", h, modules.SectorSize/crypto.SegmentSize)
+	} else if h != uint64(math.Log2(float64(modules.SectorSize/crypto.SegmentSize))) {
+		t.Fatal("wrong tree height:", h)
+	}
+}
+
+// TestEditorUploadOnto tests that UploadOnto builds on the supplied base
+// revision, and rejects stale, foreign, or mismatched bases.
+func TestEditorUploadOnto(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+
+	base := he.contract.LastRevision
+	base.NewRevisionNumber++
+	contract, _, err := he.UploadOnto(base, fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if contract.LastRevision.NewRevisionNumber != base.NewRevisionNumber+1 {
+		t.Fatal("revision was not built on the base:", contract.LastRevision.NewRevisionNumber)
+	}
+
+	// a base older than the last revision should be rejected
+	if _, _, err := he.UploadOnto(base, fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected stale base to be rejected")
+	}
+	// as should a base for a different contract
+	other := he.contract.LastRevision
+	other.ParentID = types.FileContractID{9}
+	if _, _, err := he.UploadOnto(other, fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected foreign base to be rejected")
+	}
+	// and bases that do not cover the contract's sectors
+	badRoot := he.contract.LastRevision
+	badRoot.NewRevisionNumber++
+	badRoot.NewFileMerkleRoot = crypto.Hash{1}
+	if _, _, err := he.UploadOnto(badRoot, fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected base with wrong Merkle root to be rejected")
+	}
+	badSize := he.contract.LastRevision
+	badSize.NewRevisionNumber++
+	badSize.NewFileSize += modules.SectorSize
+	if _, _, err := he.UploadOnto(badSize, fastrand.Bytes(int(modules.SectorSize))); err == nil {
+		t.Fatal("expected base with wrong file size to be rejected")
+	}
+	// a failed upload should leave the last revision unchanged
+	he.height = he.contract.FileContract.WindowEnd
+	last := he.contract.LastRevision
+	ahead := last
+	ahead.NewRevisionNumber += 5
+	if _, _, err := he.UploadOnto(ahead, fastrand.Bytes(int(modules.SectorSize))); err != ErrContractExpired {
+		t.Fatal("expected ErrContractExpired, got", err)
+	} else if !reflect.DeepEqual(he.contract.LastRevision, last) {
+		t.Fatal("last revision changed after failed upload")
+	}
+}
+
+// TestEditorProjectCost tests that ProjectCost matches the amount paid by
+// Upload.
+func TestEditorProjectCost(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+
+	for _, n := range []uint64{0, 1, 3} {
+		cost, err := he.ProjectCost(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := he.contract.RenterFunds()
+		for i := uint64(0); i < n; i++ {
+			if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if paid := before.Sub(he.contract.RenterFunds()); !paid.Equals(cost) {
+			t.Fatalf("projected %v for %v sectors, but paid %v", cost, n, paid)
+		}
+	}
+
+	he.height = he.contract.FileContract.WindowEnd
+	if _, err := he.ProjectCost(1); err != ErrContractExpired {
+		t.Fatal("expected ErrContractExpired, got", err)
+	}
+}
+
+// TestEditorUploadRate tests that an Editor with a limited upload rate takes
+// at least the expected time to upload a sector.
+func TestEditorUploadRate(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	he, host := newTestEditor(t)
+	defer he.Close()
+	rate := int64(2 * modules.SectorSize)
+	he.uploadRate = rate
+	he.conn = newRateLimitedConn(he.conn, rate)
+
+	// the sector is written in 5 chunks; only the first is written
+	// immediately
+	start := time.Now()
+	_, root, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatal("upload was not rate limited; took", elapsed)
+	} else if !reflect.DeepEqual(host.Roots(), []crypto.Hash{root}) {
+		t.Fatal("host did not receive sector")
+	}
+}
+
+// TestEditorSetHost tests that SetHost updates the prices used by the Editor,
+// and rejects entries for a different host.
+func TestEditorSetHost(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+
+	before, err := he.ProjectCost(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := he.host
+	host.UploadBandwidthPrice = host.UploadBandwidthPrice.Mul64(2)
+	host.NetAddress = "newhost.com:1234"
+	if err := he.SetHost(host); err != nil {
+		t.Fatal(err)
+	}
+	after, err := he.ProjectCost(1)
+	if err != nil {
+		t.Fatal(err)
+	} else if after.Cmp(before) <= 0 {
+		t.Fatalf("cost did not increase after raising prices: %v -> %v", before, after)
+	}
+
+	_, pk := crypto.GenerateKeyPair()
+	host.PublicKey = types.Ed25519PublicKey(pk)
+	if err := he.SetHost(host); err == nil {
+		t.Fatal("expected SetHost to reject a different public key")
+	} else if he.host.PublicKey.String() == host.PublicKey.String() {
+		t.Fatal("host entry was replaced despite error")
+	}
+}
+
+// TestEditorOnProgress tests that OnProgress is called with increasing byte
+// counts as a sector is sent to the host.
+func TestEditorOnProgress(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+
+	var sent []uint64
+	var total uint64
+	he.OnProgress = func(bytesSent, n uint64) {
+		sent = append(sent, bytesSent)
+		total = n
+	}
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+	if total <= modules.SectorSize {
+		t.Fatal("total does not include the sector:", total)
+	} else if uint64(len(sent)) < modules.SectorSize/progressChunkSize {
+		t.Fatal("too few progress reports:", len(sent))
+	} else if sent[len(sent)-1] != total {
+		t.Fatalf("final progress %v does not match total %v", sent[len(sent)-1], total)
+	}
+	for i := 1; i < len(sent); i++ {
+		if sent[i] <= sent[i-1] {
+			t.Fatal("progress did not increase:", sent[i-1], sent[i])
+		}
+	}
+}
+
+// TestNewEditorResolver tests that NewEditor dials the address returned by
+// the Resolver rather than the contract's NetAddress.
+func TestNewEditorResolver(t *testing.T) {
+	he, host := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	sigs := signRevision(contract.LastRevision, contract.SecretKey, host.sk)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(conn, contract.LastRevision, sigs)
+		}
+	}()
+	contract.NetAddress = "fakehost.invalid:1234"
+
+	var resolved []modules.NetAddress
+	he, err = NewEditor(he.host, contract, 0, new(testHostDB), nil, EditorOptions{
+		Resolver: func(addr modules.NetAddress) (string, error) {
+			resolved = append(resolved, addr)
+			return l.Addr().String(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he.Close()
+	if !reflect.DeepEqual(resolved, []modules.NetAddress{contract.NetAddress}) {
+		t.Fatal("Resolver was not called with the contract's address:", resolved)
+	}
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a resolver error should prevent dialing
+	_, err = NewEditor(he.host, contract, 0, new(testHostDB), nil, EditorOptions{
+		Resolver: func(modules.NetAddress) (string, error) {
+			return "", errors.New("unknown host")
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown host") {
+		t.Fatal("expected resolver error, got", err)
+	}
+}
+
+// TestEditorExportState tests that an Editor resumed from exported state can
+// continue the session over the original connection.
+func TestEditorExportState(t *testing.T) {
+	he, host := newTestEditor(t)
+	if _, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	}
+	state := he.ExportState()
+
+	// the contract set must have the roots committed to by the revision
+	stale := NewContractSet([]modules.RenterContract{{ID: he.contract.ID, SecretKey: he.contract.SecretKey}})
+	if _, err := ImportEditorState(he.conn, state, &stale, new(testHostDB)); err != ErrMerkleRootMismatch {
+		t.Fatal("expected ErrMerkleRootMismatch, got", err)
+	}
+	empty := NewContractSet(nil)
+	if _, err := ImportEditorState(he.conn, state, &empty, new(testHostDB)); err != ErrContractNotFound {
+		t.Fatal("expected ErrContractNotFound, got", err)
+	}
+
+	cs := NewContractSet([]modules.RenterContract{he.contract})
+	he2, err := ImportEditorState(he.conn, state, &cs, new(testHostDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he2.Close()
+	if !bytes.Equal(encoding.Marshal(he2.contract), encoding.Marshal(he.contract)) {
+		t.Fatal("imported contract does not match exported contract")
+	} else if he2.host.PublicKey.String() != he.host.PublicKey.String() || he2.height != he.height {
+		t.Fatal("imported host or height does not match")
+	}
+	if _, _, err := he2.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(host.Roots(), []crypto.Hash(he2.contract.MerkleRoots)) {
+		t.Fatal("host roots do not match imported Editor's roots")
+	}
+}
+
+// TestEditorMaxPriceLeeway tests that an upload rejected by the host for
+// underpaying is retried once with MaxPriceLeeway.
+func TestEditorMaxPriceLeeway(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	sigs := signRevision(he.contract.LastRevision, he.contract.SecretKey, host.sk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go host.serveRecentRevision(conn, he.contract.LastRevision, sigs)
+		}
+	}()
+	he.contract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	// demand slightly more than the default leeway pays
+	cost, err := he.ProjectCost(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.mu.Lock()
+	host.minHostPayout = he.contract.LastRevision.NewValidProofOutputs[1].Value.Add(cost).Add(types.NewCurrency64(1))
+	host.mu.Unlock()
+
+	// without MaxPriceLeeway, the upload fails
+	sector := fastrand.Bytes(int(modules.SectorSize))
+	if _, _, err := he.Upload(sector); !isPriceRejection(err) {
+		t.Fatal("expected price rejection, got", err)
+	}
+	if err := he.RefreshRevision(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry should not record an interaction beyond the rejection and
+	// the successful retry
+	hdb := he.hdb.(*testHostDB)
+	failures, successes := hdb.failures, hdb.successes
+	he.MaxPriceLeeway = he.PriceLeeway + 0.01
+	if _, _, err := he.Upload(sector); err != nil {
+		t.Fatal(err)
+	} else if hdb.failures != failures+1 || hdb.successes != successes+1 {
+		t.Fatal("wrong interactions recorded for retried upload:", hdb.failures-failures, hdb.successes-successes)
+	} else if paid := he.contract.StorageSpending.Add(he.contract.UploadSpending); paid.Cmp(cost) <= 0 {
+		t.Fatal("retry did not pay more than the default leeway:", paid, cost)
+	} else if he.PriceLeeway == he.MaxPriceLeeway {
+		t.Fatal("PriceLeeway was not restored after the retry")
+	}
+}
+
+// TestEditorUploadOntoPriceRejection tests that UploadOnto does not retry a
+// rejected upload with MaxPriceLeeway, which would discard the base revision.
+func TestEditorUploadOntoPriceRejection(t *testing.T) {
+	he, host := newTestEditor(t)
+	defer he.Close()
+	var redialed bool
+	he.resolver = func(addr modules.NetAddress) (string, error) {
+		redialed = true
+		return string(addr), nil
+	}
+
+	// demand slightly more than the default leeway pays
+	cost, err := he.ProjectCost(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.mu.Lock()
+	host.minHostPayout = he.contract.LastRevision.NewValidProofOutputs[1].Value.Add(cost).Add(types.NewCurrency64(1))
+	host.mu.Unlock()
+
+	he.MaxPriceLeeway = he.PriceLeeway + 0.01
+	last := he.contract.LastRevision
+	base := last
+	base.NewRevisionNumber++
+	if _, _, err := he.UploadOnto(base, fastrand.Bytes(int(modules.SectorSize))); !isPriceRejection(err) {
+		t.Fatal("expected price rejection, got", err)
+	} else if redialed {
+		t.Fatal("rejected upload should not have been retried")
+	} else if !reflect.DeepEqual(he.contract.LastRevision, last) {
+		t.Fatal("last revision changed after failed upload")
+	} else if he.MaxPriceLeeway != he.PriceLeeway+0.01 {
+		t.Fatal("MaxPriceLeeway was not restored")
+	}
+}
+
+// TestEditorReconnectAborted tests that an Editor aborted while reconnecting
+// stays closed, rather than adopting the new connection.
+func TestEditorReconnectAborted(t *testing.T) {
+	he, host := newTestEditor(t)
+	sigs := signRevision(he.contract.LastRevision, he.contract.SecretKey, host.sk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(conn, he.contract.LastRevision, sigs)
+		}
+	}()
+
+	old := he.conn
+	err = he.reconnect(modules.NetAddress(l.Addr().String()), func(conn net.Conn) error {
+		// simulate an Abort that lands while the new connection is being
+		// established
+		he.Abort()
+		return verifyRecentRevision(conn, he.contract, he.host.Version)
+	})
+	if err != errEditorAborted {
+		t.Fatal("expected errEditorAborted, got", err)
+	} else if he.conn != old {
+		t.Fatal("aborted Editor adopted the new connection")
+	}
+}
+
+// xorConn is a net.Conn that XORs every byte read and written with key.
+type xorConn struct {
+	net.Conn
+	key byte
+}
+
+func (c *xorConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for i := range p[:n] {
+		p[i] ^= c.key
+	}
+	return n, err
+}
+
+func (c *xorConn) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i := range p {
+		buf[i] = p[i] ^ c.key
+	}
+	return c.Conn.Write(buf)
+}
+
+// TestNewEditorWrapConn tests that the Editor communicates with the host
+// through the connection returned by WrapConn.
+func TestNewEditorWrapConn(t *testing.T) {
+	he, host := newTestEditor(t)
+	he.Close()
+	contract := he.contract
+	sigs := signRevision(contract.LastRevision, contract.SecretKey, host.sk)
+
+	const key = 0x5a
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			host.serveRecentRevision(&xorConn{conn, key}, contract.LastRevision, sigs)
+		}
+	}()
+	contract.NetAddress = modules.NetAddress(l.Addr().String())
+
+	var wrapped int
+	he, err = NewEditor(he.host, contract, 0, new(testHostDB), nil, EditorOptions{
+		WrapConn: func(conn net.Conn) (net.Conn, error) {
+			wrapped++
+			return &xorConn{conn, key}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer he.Close()
+	if wrapped != 1 {
+		t.Fatal("expected WrapConn to be called once, got", wrapped)
+	}
+	if _, root, err := he.Upload(fastrand.Bytes(int(modules.SectorSize))); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(host.Roots(), []crypto.Hash{root}) {
+		t.Fatal("host did not receive sector")
+	}
+
+	// a WrapConn error should abort NewEditor
+	_, err = NewEditor(he.host, contract, 0, new(testHostDB), nil, EditorOptions{
+		WrapConn: func(net.Conn) (net.Conn, error) {
+			return nil, errors.New("handshake failed")
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "handshake failed") {
+		t.Fatal("expected WrapConn error, got", err)
+	}
+}
+
+// TestEditorZeroCollateral tests uploading to a host that posts no
+// collateral. The collateral check must not fail when the host's missed
+// proof output is already zero.
+func TestEditorZeroCollateral(t *testing.T) {
+	he, _ := newTestEditor(t)
+	defer he.Close()
+	he.host.Collateral = types.ZeroCurrency
+	// the host's payouts must remain balanced
+	he.contract.LastRevision.NewValidProofOutputs[1].Value = types.ZeroCurrency
+	he.contract.LastRevision.NewMissedProofOutputs[1].Value = types.ZeroCurrency
+
+	contract, _, err := he.Upload(fastrand.Bytes(int(modules.SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	} else if !contract.LastRevision.NewMissedProofOutputs[1].Value.IsZero() {
+		t.Fatal("host collateral should remain zero")
+	}
+}
@@ -2,7 +2,6 @@ package proto
 
 import (
 	"errors"
-	"net"
 
 	"github.com/NebulousLabs/Sia/crypto"
 	"github.com/NebulousLabs/Sia/encoding"
@@ -22,8 +21,11 @@ func FormContract(params ContractParams, txnBuilder transactionBuilder, tpool tr
 	// Extract vars from params, for convenience.
 	host, funding, startHeight, endHeight, refundAddress := params.Host, params.Funding, params.StartHeight, params.EndHeight, params.RefundAddress
 
-	// Create our key.
+	// Create our key, unless one was supplied.
 	ourSK, ourPK := crypto.GenerateKeyPair()
+	if params.SecretKey != (crypto.SecretKey{}) {
+		ourSK, ourPK = params.SecretKey, params.SecretKey.PublicKey()
+	}
 	// Create unlock conditions.
 	uc := types.UnlockConditions{
 		PublicKeys: []types.SiaPublicKey{
@@ -109,11 +111,7 @@ func FormContract(params ContractParams, txnBuilder transactionBuilder, tpool tr
 	}()
 
 	// Initiate connection.
-	dialer := &net.Dialer{
-		Cancel:  cancel,
-		Timeout: connTimeout,
-	}
-	conn, err := dialer.Dial("tcp", string(host.NetAddress))
+	conn, err := dialHost(host.NetAddress, connTimeout, cancel)
 	if err != nil {
 		return modules.RenterContract{}, err
 	}
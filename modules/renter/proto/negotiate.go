@@ -1,7 +1,9 @@
 package proto
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
 	"time"
 
@@ -15,6 +17,136 @@ import (
 // extendDeadline is a helper function for extending the connection timeout.
 func extendDeadline(conn net.Conn, d time.Duration) { _ = conn.SetDeadline(time.Now().Add(d)) }
 
+// A clock reports the current time and schedules timers. It allows tests to
+// control the deadlines set on connections without waiting for them to
+// elapse.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// A timer is a pending call scheduled by a clock. Stop prevents the call from
+// running, returning false if it has already run or started running.
+type timer interface {
+	Stop() bool
+}
+
+// dialHost connects to the host at addr, which may be an IPv4 address, a
+// bracketed IPv6 address, or a hostname, followed by a port. If the hostname
+// resolves to multiple addresses, each is tried in order until one connects.
+// The timeout applies to the whole attempt, including name resolution, rather
+// than to each address. Closing cancel aborts the attempt.
+func dialHost(addr modules.NetAddress, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), timeout)
+	defer cancelCtx()
+	select {
+	case <-cancel:
+		cancelCtx()
+	default:
+	}
+	go func() {
+		select {
+		case <-cancel:
+			cancelCtx()
+		case <-ctx.Done():
+		}
+	}()
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if ips, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	var dialer net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		} else if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// isTransientError returns true if err is a temporary or timeout network
+// error, indicating that the operation may succeed if retried.
+func isTransientError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Temporary() || netErr.Timeout())
+}
+
+// A retryWriter wraps a net.Conn, retrying writes that fail with a transient
+// error. A retried write resumes after the bytes that were successfully
+// written, so the stream is never corrupted. The deadline of the conn is
+// extended by timeout before each retry.
+type retryWriter struct {
+	conn    net.Conn
+	retries int // remaining retries
+	backoff time.Duration
+	timeout time.Duration
+	now     func() time.Time // defaults to time.Now
+}
+
+// Write implements io.Writer.
+func (w *retryWriter) Write(p []byte) (int, error) {
+	var written int
+	for {
+		n, err := w.conn.Write(p[written:])
+		written += n
+		if err == nil || w.retries <= 0 || !isTransientError(err) {
+			return written, err
+		}
+		w.retries--
+		time.Sleep(w.backoff)
+		now := time.Now
+		if w.now != nil {
+			now = w.now
+		}
+		_ = w.conn.SetDeadline(now().Add(w.timeout))
+	}
+}
+
+// progressChunkSize is the largest write that a progressWriter passes to its
+// underlying writer at once, and thus the granularity of its progress reports.
+const progressChunkSize = 1 << 16
+
+// A progressWriter wraps an io.Writer, splitting large writes into chunks and
+// calling fn with the running total of bytes written after each chunk.
+type progressWriter struct {
+	w     io.Writer
+	sent  uint64
+	total uint64
+	fn    func(sent, total uint64)
+}
+
+// Write implements io.Writer.
+func (w *progressWriter) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > progressChunkSize {
+			chunk = chunk[:progressChunkSize]
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		w.sent += uint64(n)
+		if n > 0 {
+			w.fn(w.sent, w.total)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 // startRevision is run at the beginning of each revision iteration. It reads
 // the host's settings confirms that the values are acceptable, and writes an acceptance.
 func startRevision(conn net.Conn, host modules.HostDBEntry) error {
@@ -66,17 +198,18 @@ func verifySettings(conn net.Conn, host modules.HostDBEntry) (modules.HostDBEntr
 	return host, nil
 }
 
-// verifyRecentRevision confirms that the host and contractor agree upon the current
-// state of the contract being revised.
-func verifyRecentRevision(conn net.Conn, contract modules.RenterContract, hostVersion string) error {
+// getRecentRevision requests the host's most recent revision of the contract
+// being revised, and returns it along with the signatures on it. It also
+// checks that the revision's unlock conditions match those of contract.
+func getRecentRevision(conn net.Conn, contract modules.RenterContract, hostVersion string) (types.FileContractRevision, []types.TransactionSignature, error) {
 	// send contract ID
 	if err := encoding.WriteObject(conn, contract.ID); err != nil {
-		return errors.New("couldn't send contract ID: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("couldn't send contract ID: " + err.Error())
 	}
 	// read challenge
 	var challenge crypto.Hash
 	if err := encoding.ReadObject(conn, &challenge, 32); err != nil {
-		return errors.New("couldn't read challenge: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("couldn't read challenge: " + err.Error())
 	}
 	if build.VersionCmp(hostVersion, "1.3.0") >= 0 {
 		crypto.SecureWipe(challenge[:16])
@@ -84,26 +217,38 @@ func verifyRecentRevision(conn net.Conn, contract modules.RenterContract, hostVe
 	// sign and return
 	sig := crypto.SignHash(challenge, contract.SecretKey)
 	if err := encoding.WriteObject(conn, sig); err != nil {
-		return errors.New("couldn't send challenge response: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("couldn't send challenge response: " + err.Error())
 	}
 	// read acceptance
 	if err := modules.ReadNegotiationAcceptance(conn); err != nil {
-		return errors.New("host did not accept revision request: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("host did not accept revision request: " + err.Error())
 	}
 	// read last revision and signatures
 	var lastRevision types.FileContractRevision
 	var hostSignatures []types.TransactionSignature
 	if err := encoding.ReadObject(conn, &lastRevision, 2048); err != nil {
-		return errors.New("couldn't read last revision: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("couldn't read last revision: " + err.Error())
 	}
 	if err := encoding.ReadObject(conn, &hostSignatures, 2048); err != nil {
-		return errors.New("couldn't read host signatures: " + err.Error())
+		return types.FileContractRevision{}, nil, errors.New("couldn't read host signatures: " + err.Error())
 	}
 	// Check that the unlock hashes match; if they do not, something is
-	// seriously wrong. Otherwise, check that the revision numbers match.
+	// seriously wrong.
 	if lastRevision.UnlockConditions.UnlockHash() != contract.LastRevision.UnlockConditions.UnlockHash() {
-		return errors.New("unlock conditions do not match")
-	} else if lastRevision.NewRevisionNumber != contract.LastRevision.NewRevisionNumber {
+		return types.FileContractRevision{}, nil, errors.New("unlock conditions do not match")
+	}
+	return lastRevision, hostSignatures, nil
+}
+
+// verifyRecentRevision confirms that the host and contractor agree upon the current
+// state of the contract being revised.
+func verifyRecentRevision(conn net.Conn, contract modules.RenterContract, hostVersion string) error {
+	lastRevision, hostSignatures, err := getRecentRevision(conn, contract, hostVersion)
+	if err != nil {
+		return err
+	}
+	// check that the revision numbers match
+	if lastRevision.NewRevisionNumber != contract.LastRevision.NewRevisionNumber {
 		return &recentRevisionError{contract.LastRevision.NewRevisionNumber, lastRevision.NewRevisionNumber}
 	}
 	// NOTE: we can fake the blockheight here because it doesn't affect
@@ -115,6 +260,17 @@ func verifyRecentRevision(conn net.Conn, contract modules.RenterContract, hostVe
 // negotiateRevision sends a revision and actions to the host for approval,
 // completing one iteration of the revision loop.
 func negotiateRevision(conn net.Conn, rev types.FileContractRevision, secretKey crypto.SecretKey) (types.Transaction, error) {
+	signedTxn, err := sendRevision(conn, rev, secretKey)
+	if err != nil {
+		return types.Transaction{}, err
+	}
+	return receiveRevisionSignature(conn, signedTxn)
+}
+
+// sendRevision sends a revision to the host for approval, followed by the
+// renter's signature of the revision. It returns the partially-signed
+// revision transaction.
+func sendRevision(conn net.Conn, rev types.FileContractRevision, secretKey crypto.SecretKey) (types.Transaction, error) {
 	// create transaction containing the revision
 	signedTxn := types.Transaction{
 		FileContractRevisions: []types.FileContractRevision{rev},
@@ -141,6 +297,13 @@ func negotiateRevision(conn net.Conn, rev types.FileContractRevision, secretKey
 	if err := encoding.WriteObject(conn, signedTxn.TransactionSignatures[0]); err != nil {
 		return types.Transaction{}, errors.New("couldn't send transaction signature: " + err.Error())
 	}
+	return signedTxn, nil
+}
+
+// receiveRevisionSignature reads the host's signature of a revision
+// transaction previously sent by sendRevision, and returns the fully-signed
+// transaction.
+func receiveRevisionSignature(conn net.Conn, signedTxn types.Transaction) (types.Transaction, error) {
 	// read the host's acceptance and transaction signature
 	// NOTE: if the host sends ErrStopResponse, we should continue processing
 	// the revision, but return the error anyway.
@@ -157,7 +320,7 @@ func negotiateRevision(conn net.Conn, rev types.FileContractRevision, secretKey
 	// NOTE: we can fake the blockheight here because it doesn't affect
 	// verification; it just needs to be above the fork height and below the
 	// contract expiration (which was checked earlier).
-	verificationHeight := rev.NewWindowStart - 1
+	verificationHeight := signedTxn.FileContractRevisions[0].NewWindowStart - 1
 	signedTxn.TransactionSignatures = append(signedTxn.TransactionSignatures, hostSig)
 	if err := signedTxn.StandaloneValid(verificationHeight); err != nil {
 		return types.Transaction{}, err
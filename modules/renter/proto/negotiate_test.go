@@ -1,9 +1,11 @@
 package proto
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/NebulousLabs/Sia/crypto"
 	"github.com/NebulousLabs/Sia/encoding"
@@ -62,3 +64,113 @@ func TestNegotiateRevisionStopResponse(t *testing.T) {
 	}
 	rConn.Close()
 }
+
+// timeoutError is a transient net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyConn is a net.Conn whose writes fail with the errors in errs, writing
+// only half of the data each time, before succeeding.
+type flakyConn struct {
+	net.Conn
+	errs []error
+	buf  bytes.Buffer
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		n, _ := c.buf.Write(p[:len(p)/2])
+		return n, err
+	}
+	return c.buf.Write(p)
+}
+
+// TestRetryWriter tests that retryWriter retries transient errors without
+// corrupting the written data, and does not retry permanent errors.
+func TestRetryWriter(t *testing.T) {
+	// the underlying conn is only used for setting deadlines
+	rConn, hConn := net.Pipe()
+	defer rConn.Close()
+	defer hConn.Close()
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	// a transient error should be retried
+	fc := &flakyConn{Conn: rConn, errs: []error{timeoutError{}}}
+	w := &retryWriter{conn: fc, retries: 1}
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatal("expected write to succeed, got", n, err)
+	} else if !bytes.Equal(fc.buf.Bytes(), data) {
+		t.Fatal("retried write corrupted data:", fc.buf.String())
+	}
+
+	// a transient error should not be retried if no retries remain
+	fc = &flakyConn{Conn: rConn, errs: []error{timeoutError{}, timeoutError{}}}
+	w = &retryWriter{conn: fc, retries: 1}
+	if _, err := w.Write(data); err != (timeoutError{}) {
+		t.Fatal("expected timeout error, got", err)
+	}
+
+	// a permanent error should never be retried
+	errPermanent := errors.New("connection reset")
+	fc = &flakyConn{Conn: rConn, errs: []error{errPermanent}}
+	w = &retryWriter{conn: fc, retries: 3}
+	if _, err := w.Write(data); err != errPermanent {
+		t.Fatal("expected permanent error, got", err)
+	}
+}
+
+// TestDialHost tests that dialHost can connect to IPv4, IPv6, and hostname
+// addresses.
+func TestDialHost(t *testing.T) {
+	accept := func(l net.Listener) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}
+	l4, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l4.Close()
+	go accept(l4)
+	_, port, _ := net.SplitHostPort(l4.Addr().String())
+	addrs := []modules.NetAddress{
+		modules.NetAddress(l4.Addr().String()),
+		modules.NetAddress(net.JoinHostPort("localhost", port)),
+	}
+	if l6, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Log("IPv6 loopback unavailable:", err)
+	} else {
+		defer l6.Close()
+		go accept(l6)
+		addrs = append(addrs, modules.NetAddress(l6.Addr().String()))
+	}
+	for _, addr := range addrs {
+		conn, err := dialHost(addr, time.Second, nil)
+		if err != nil {
+			t.Errorf("could not dial %v: %v", addr, err)
+			continue
+		}
+		conn.Close()
+	}
+
+	// an unbracketed IPv6 address is ambiguous
+	if _, err := dialHost("::1:9982", time.Second, nil); err == nil {
+		t.Error("expected unbracketed IPv6 address to be rejected")
+	}
+	// closing cancel should abort the dial
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := dialHost(modules.NetAddress(l4.Addr().String()), time.Second, cancel); err == nil {
+		t.Error("expected cancelled dial to fail")
+	}
+}
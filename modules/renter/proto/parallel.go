@@ -0,0 +1,135 @@
+package proto
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// errNoEditors is the error reported by UploadParallel for sectors that
+// could not be attempted because every editor had failed.
+var errNoEditors = errors.New("no editors remaining to upload with")
+
+// ParallelUploadOptions configures UploadParallel.
+type ParallelUploadOptions struct {
+	// Concurrency is the maximum number of sectors uploaded at once. It
+	// defaults to the number of editors.
+	Concurrency int
+
+	// MaxAttempts is the maximum number of editors that will be tried for
+	// each sector. It defaults to the number of editors.
+	MaxAttempts int
+}
+
+// A SectorResult is the outcome of uploading one sector with
+// UploadParallel. If Err is nil, the sector was stored in the contract
+// ContractID with the host Host. Otherwise, Err is the error from the last
+// attempt.
+type SectorResult struct {
+	Root       crypto.Hash
+	Host       types.SiaPublicKey
+	ContractID types.FileContractID
+	Err        error
+}
+
+// UploadParallel uploads sectors across editors, which may be connected to
+// different hosts, returning the result for each sector in order. Each editor
+// uploads one sector at a time, and at most opts.Concurrency uploads are in
+// progress at once. If an upload fails, the editor is no longer used, since
+// its connection or contract may be unusable, and the sector is queued for
+// another editor unless it has reached opts.MaxAttempts. The editors must not
+// be used by anything else until UploadParallel returns.
+func UploadParallel(editors []*Editor, sectors [][]byte, opts ParallelUploadOptions) []SectorResult {
+	results := make([]SectorResult, len(sectors))
+	if len(sectors) == 0 {
+		return results
+	} else if len(editors) == 0 {
+		for i := range results {
+			results[i].Err = errNoEditors
+		}
+		return results
+	}
+	concurrency, maxAttempts := opts.Concurrency, opts.MaxAttempts
+	if concurrency <= 0 {
+		concurrency = len(editors)
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = len(editors)
+	}
+
+	// queue holds the indices of sectors awaiting upload; remaining is the
+	// number of sectors without a final result
+	queue := make([]int, len(sectors))
+	for i := range queue {
+		queue[i] = i
+	}
+	attempts := make([]int, len(sectors))
+	remaining := len(sectors)
+	alive := len(editors)
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for _, he := range editors {
+		wg.Add(1)
+		go func(he *Editor) {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && remaining > 0 {
+					cond.Wait()
+				}
+				if remaining == 0 {
+					mu.Unlock()
+					return
+				}
+				i := queue[0]
+				queue = queue[1:]
+				attempts[i]++
+				mu.Unlock()
+
+				sem <- struct{}{}
+				_, root, err := he.Upload(sectors[i])
+				<-sem
+
+				mu.Lock()
+				if err == nil {
+					results[i] = SectorResult{
+						Root:       root,
+						Host:       he.contract.HostPublicKey,
+						ContractID: he.contract.ID,
+					}
+					remaining--
+					cond.Broadcast()
+					mu.Unlock()
+					continue
+				}
+				results[i].Err = err
+				alive--
+				if attempts[i] < maxAttempts && alive > 0 {
+					queue = append(queue, i)
+				} else {
+					remaining--
+				}
+				if alive == 0 {
+					// no editor is left to upload the queued sectors
+					for _, j := range queue {
+						if results[j].Err == nil {
+							results[j].Err = errNoEditors
+						}
+					}
+					remaining -= len(queue)
+					queue = nil
+				}
+				cond.Broadcast()
+				mu.Unlock()
+				return
+			}
+		}(he)
+	}
+	wg.Wait()
+	return results
+}
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/NebulousLabs/Sia/crypto"
 	"github.com/NebulousLabs/Sia/modules"
@@ -32,6 +33,17 @@ type (
 		IncrementSuccessfulInteractions(key types.SiaPublicKey)
 		IncrementFailedInteractions(key types.SiaPublicKey)
 	}
+
+	// rttRecorder is an optional extension of hostDB that records the
+	// round-trip time measured when connecting to a host.
+	rttRecorder interface {
+		RecordRTT(key types.SiaPublicKey, rtt time.Duration)
+	}
+
+	// logger is satisfied by *persist.Logger.
+	logger interface {
+		Printf(format string, v ...interface{})
+	}
 )
 
 // ContractParams are supplied as an argument to FormContract.
@@ -41,7 +53,11 @@ type ContractParams struct {
 	StartHeight   types.BlockHeight
 	EndHeight     types.BlockHeight
 	RefundAddress types.UnlockHash
-	// TODO: add optional keypair
+	// SecretKey, if set, is the renter's key for the new contract. If unset,
+	// FormContract generates a new key and Renew reuses the key of the
+	// contract being renewed. Renewing with a new key is the only way to
+	// rotate a contract's key, since its unlock conditions cannot be revised.
+	SecretKey crypto.SecretKey
 }
 
 // A revisionSaver is called just before we send our revision signature to the host; this
@@ -0,0 +1,98 @@
+package proto
+
+import (
+	"errors"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// defaultQueueDepth is the number of uploads buffered by QueueUpload if the
+// Editor's QueueDepth is not set.
+const defaultQueueDepth = 16
+
+// ErrQueueFull is returned by QueueUpload if the upload queue is full and the
+// Editor's RejectFullQueue field is set.
+var ErrQueueFull = errors.New("upload queue is full")
+
+// An UploadResult is the outcome of an upload submitted with QueueUpload.
+type UploadResult struct {
+	Contract modules.RenterContract
+	Root     crypto.Hash
+	Err      error
+}
+
+// A queuedUpload is a sector waiting to be uploaded, and the channel on which
+// the result is delivered.
+type queuedUpload struct {
+	data   []byte
+	result chan UploadResult
+}
+
+// QueueUpload submits data to be uploaded as if by Upload, and returns a
+// channel on which the result will be delivered. Queued uploads are
+// performed in the order they were submitted, one at a time, on a separate
+// goroutine. If the queue is full, QueueUpload blocks until there is room,
+// or, if RejectFullQueue is set, delivers ErrQueueFull immediately.
+//
+// QueueUpload may be called concurrently, but since Editors are not
+// thread-safe, no other methods may be called until every queued upload has
+// delivered its result.
+func (he *Editor) QueueUpload(data []byte) <-chan UploadResult {
+	u := queuedUpload{
+		data:   data,
+		result: make(chan UploadResult, 1),
+	}
+
+	he.queueMu.Lock()
+	if he.queue == nil {
+		depth := he.QueueDepth
+		if depth <= 0 {
+			depth = defaultQueueDepth
+		}
+		he.queue = make(chan queuedUpload, depth)
+	}
+	queue := he.queue
+	he.queueMu.Unlock()
+
+	if he.RejectFullQueue {
+		select {
+		case queue <- u:
+		default:
+			u.result <- UploadResult{Err: ErrQueueFull}
+			return u.result
+		}
+	} else {
+		queue <- u
+	}
+
+	// start a goroutine to drain the queue, unless one is already running
+	he.queueMu.Lock()
+	if !he.draining {
+		he.draining = true
+		go he.drainQueue()
+	}
+	he.queueMu.Unlock()
+	return u.result
+}
+
+// drainQueue uploads the sectors in the queue until it is empty.
+func (he *Editor) drainQueue() {
+	for {
+		he.queueMu.Lock()
+		select {
+		case u := <-he.queue:
+			he.queueMu.Unlock()
+			contract, root, err := he.Upload(u.data)
+			u.result <- UploadResult{
+				Contract: contract,
+				Root:     root,
+				Err:      err,
+			}
+		default:
+			he.draining = false
+			he.queueMu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package proto
+
+import (
+	"net"
+	"time"
+)
+
+// rateLimitedConn is a net.Conn whose writes are throttled to a fixed number
+// of bytes per second. Reads are not limited.
+type rateLimitedConn struct {
+	net.Conn
+	rate int64     // bytes per second
+	next time.Time // earliest time at which the next chunk may be written
+}
+
+// Write implements io.Writer. p is written in chunks of at most a tenth of a
+// second's worth of data, sleeping before each chunk as needed to keep the
+// average rate at or below c.rate. Time spent idle does not accumulate, so a
+// burst never exceeds one chunk.
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	chunkSize := int(c.rate / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		now := time.Now()
+		if c.next.Before(now) {
+			c.next = now
+		}
+		time.Sleep(c.next.Sub(now))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.next = c.next.Add(time.Duration(int64(n) * int64(time.Second) / c.rate))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// newRateLimitedConn wraps conn so that its writes are limited to rate bytes
+// per second. If rate is not positive, conn is returned unchanged.
+func newRateLimitedConn(conn net.Conn, rate int64) net.Conn {
+	if rate <= 0 {
+		return conn
+	}
+	return &rateLimitedConn{Conn: conn, rate: rate}
+}
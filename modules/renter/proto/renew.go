@@ -2,7 +2,6 @@ package proto
 
 import (
 	"errors"
-	"net"
 
 	"github.com/NebulousLabs/Sia/crypto"
 	"github.com/NebulousLabs/Sia/encoding"
@@ -10,12 +9,26 @@ import (
 	"github.com/NebulousLabs/Sia/types"
 )
 
+// rekeyUnlockConditions returns a copy of uc in which the renter's public key
+// is replaced by pk.
+func rekeyUnlockConditions(uc types.UnlockConditions, pk crypto.PublicKey) types.UnlockConditions {
+	keys := append([]types.SiaPublicKey(nil), uc.PublicKeys...)
+	keys[0] = types.Ed25519PublicKey(pk)
+	uc.PublicKeys = keys
+	return uc
+}
+
 // Renew negotiates a new contract for data already stored with a host, and
 // submits the new contract transaction to tpool.
 func Renew(contract modules.RenterContract, params ContractParams, txnBuilder transactionBuilder, tpool transactionPool, hdb hostDB, cancel <-chan struct{}) (modules.RenterContract, error) {
 	// extract vars from params, for convenience
 	host, funding, startHeight, endHeight, refundAddress := params.Host, params.Funding, params.StartHeight, params.EndHeight, params.RefundAddress
 	ourSK := contract.SecretKey
+	uc := contract.LastRevision.UnlockConditions
+	if params.SecretKey != (crypto.SecretKey{}) {
+		ourSK = params.SecretKey
+		uc = rekeyUnlockConditions(uc, ourSK.PublicKey())
+	}
 
 	// Calculate additional basePrice and baseCollateral. If the contract height
 	// did not increase, basePrice and baseCollateral are zero.
@@ -65,7 +78,7 @@ func Renew(contract modules.RenterContract, params ContractParams, txnBuilder tr
 		WindowStart:    endHeight,
 		WindowEnd:      endHeight + host.WindowSize,
 		Payout:         totalPayout,
-		UnlockHash:     contract.LastRevision.NewUnlockHash,
+		UnlockHash:     uc.UnlockHash(),
 		RevisionNumber: 0,
 		ValidProofOutputs: []types.SiacoinOutput{
 			// renter
@@ -107,11 +120,7 @@ func Renew(contract modules.RenterContract, params ContractParams, txnBuilder tr
 	}()
 
 	// initiate connection
-	dialer := &net.Dialer{
-		Cancel:  cancel,
-		Timeout: connTimeout,
-	}
-	conn, err := dialer.Dial("tcp", string(host.NetAddress))
+	conn, err := dialHost(host.NetAddress, connTimeout, cancel)
 	if err != nil {
 		return modules.RenterContract{}, err
 	}
@@ -195,7 +204,7 @@ func Renew(contract modules.RenterContract, params ContractParams, txnBuilder tr
 	// create initial (no-op) revision, transaction, and signature
 	initRevision := types.FileContractRevision{
 		ParentID:          signedTxnSet[len(signedTxnSet)-1].FileContractID(0),
-		UnlockConditions:  contract.LastRevision.UnlockConditions,
+		UnlockConditions:  uc,
 		NewRevisionNumber: 1,
 
 		NewFileSize:           fc.FileSize,
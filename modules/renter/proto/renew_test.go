@@ -0,0 +1,32 @@
+package proto
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// TestRekeyUnlockConditions tests that rekeyUnlockConditions replaces only
+// the renter's key, without modifying the original unlock conditions.
+func TestRekeyUnlockConditions(t *testing.T) {
+	renterSK, renterPK := crypto.GenerateKeyPair()
+	_, hostPK := crypto.GenerateKeyPair()
+	old := newTestContract(renterSK, renterPK, hostPK).LastRevision.UnlockConditions
+
+	_, newPK := crypto.GenerateKeyPair()
+	uc := rekeyUnlockConditions(old, newPK)
+	if !reflect.DeepEqual(uc.PublicKeys[0], types.Ed25519PublicKey(newPK)) {
+		t.Fatal("renter key was not replaced")
+	} else if !reflect.DeepEqual(uc.PublicKeys[1], types.Ed25519PublicKey(hostPK)) {
+		t.Fatal("host key was modified")
+	} else if uc.SignaturesRequired != old.SignaturesRequired {
+		t.Fatal("signature requirement was modified")
+	} else if uc.UnlockHash() == old.UnlockHash() {
+		t.Fatal("unlock hash should change with the renter key")
+	}
+	if !reflect.DeepEqual(old.PublicKeys[0], types.Ed25519PublicKey(renterPK)) {
+		t.Fatal("original unlock conditions were modified")
+	}
+}